@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// --- CÓDIGOS DE BARRAS CODE 128 Y LIENZOS DE ETIQUETAS ---
+
+// code128Patterns : Anchos barra/espacio de cada símbolo (0-102 datos, 103-105 inicio A/B/C, 106 parada)
+var code128Patterns = []string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
+
+const (
+	code128StartB = 104
+	code128StartC = 105
+	code128Stop   = 106
+)
+
+// code128Encodable : true si el valor no está vacío y todos sus caracteres son ASCII imprimible (subconjunto B)
+func code128Encodable(value string) bool {
+	if value == "" { return false }
+	for _, c := range value {
+		if c < 32 || c > 126 { return false }
+	}
+	return true
+}
+
+// code128Widths : Anchos en módulos, alternando barra y espacio (empieza con barra). Usa el subconjunto C
+// (dos dígitos por símbolo) si el valor es numérico de largo par; si no, el B. Los caracteres fuera de
+// ASCII imprimible se codifican como '?' (ver code128Encodable).
+func code128Widths(value string) []int {
+	symbols := []int{}
+	digits := len(value) >= 4 && len(value)%2 == 0
+	for _, c := range value {
+		if c < '0' || c > '9' { digits = false; break }
+	}
+	if digits {
+		symbols = append(symbols, code128StartC)
+		for i := 0; i < len(value); i += 2 {
+			symbols = append(symbols, int(value[i]-'0')*10+int(value[i+1]-'0'))
+		}
+	} else {
+		symbols = append(symbols, code128StartB)
+		for _, c := range value {
+			if c < 32 || c > 126 { c = '?' }
+			symbols = append(symbols, int(c)-32)
+		}
+	}
+	checksum := symbols[0]
+	for i, s := range symbols[1:] { checksum += s * (i + 1) }
+	symbols = append(symbols, checksum%103, code128Stop)
+
+	widths := []int{}
+	for _, s := range symbols {
+		for _, w := range code128Patterns[s] { widths = append(widths, int(w-'0')) }
+	}
+	return widths
+}
+
+// labelCanvas : Superficie donde se dibujan las hojas de etiquetas (PDF o SVG), en puntos desde arriba a la izquierda
+type labelCanvas interface {
+	NewPage()
+	Bar(x, y, w, h float64)
+	Text(x, y, width, size float64, bold bool, align, s string)
+}
+
+// drawCode128 : Código de barras centrado en el recuadro, con zona de silencio de 10 módulos a cada lado
+func drawCode128(c labelCanvas, value string, x, y, w, h float64) {
+	widths := code128Widths(value)
+	modules := 20
+	for _, m := range widths { modules += m }
+	module := w / float64(modules)
+	if module > 1.5 { module = 1.5 }
+	cx := x + (w-module*float64(modules))/2 + 10*module
+	for i, m := range widths {
+		if i%2 == 0 { c.Bar(cx, y, float64(m)*module, h) }
+		cx += float64(m) * module
+	}
+}
+
+// fitText : Recorta el texto con "…" para que quepa en el ancho
+func fitText(s string, size float64, bold bool, width float64) string {
+	if pdfTextWidth(s, size, bold) <= width { return s }
+	runes := []rune(s)
+	for len(runes) > 0 && pdfTextWidth(string(runes)+"…", size, bold) > width { runes = runes[:len(runes)-1] }
+	return string(runes) + "…"
+}
+
+type pdfLabelCanvas struct{ pdf *PDF }
+
+func (c *pdfLabelCanvas) NewPage()                { c.pdf.AddPage() }
+func (c *pdfLabelCanvas) Bar(x, y, w, h float64) { c.pdf.Rect(x, y, w, h, true, false) }
+func (c *pdfLabelCanvas) Text(x, y, width, size float64, bold bool, align, s string) {
+	c.pdf.TextAligned(x, y, width, size, bold, align, s)
+}
+
+// svgLabelCanvas : Las páginas se apilan verticalmente en un solo SVG (una hoja carta por página)
+type svgLabelCanvas struct {
+	b     strings.Builder
+	pages int
+}
+
+func (c *svgLabelCanvas) NewPage() {
+	if c.pages > 0 {
+		fmt.Fprintf(&c.b, `<line x1="0" y1="%.2f" x2="%.0f" y2="%.2f" stroke="#ccc" stroke-dasharray="4 4"/>`+"\n", float64(c.pages)*pdfPageHeight, pdfPageWidth, float64(c.pages)*pdfPageHeight)
+	}
+	c.pages++
+}
+
+func (c *svgLabelCanvas) offset() float64 { return float64(c.pages-1) * pdfPageHeight }
+
+func (c *svgLabelCanvas) Bar(x, y, w, h float64) {
+	fmt.Fprintf(&c.b, `<rect x="%.3f" y="%.3f" width="%.3f" height="%.3f"/>`+"\n", x, y+c.offset(), w, h)
+}
+
+func (c *svgLabelCanvas) Text(x, y, width, size float64, bold bool, align, s string) {
+	anchor := "start"
+	switch align {
+	case "C":
+		anchor, x = "middle", x+width/2
+	case "R":
+		anchor, x = "end", x+width
+	}
+	weight := ""
+	if bold { weight = ` font-weight="bold"` }
+	fmt.Fprintf(&c.b, `<text x="%.2f" y="%.2f" font-size="%.2f" text-anchor="%s"%s>%s</text>`+"\n", x, y+c.offset(), size, anchor, weight, xmlEscape(s))
+}
+
+// Output : Documento SVG completo (tamaño carta por página, en unidades de punto)
+func (c *svgLabelCanvas) Output() string {
+	height := float64(c.pages) * pdfPageHeight
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" width="8.5in" height="%.2fin" viewBox="0 0 %.0f %.0f" font-family="Helvetica, Arial, sans-serif">
+<rect width="100%%" height="100%%" fill="white"/>
+<g fill="black">
+%s</g>
+</svg>
+`, 11*float64(c.pages), pdfPageWidth, height, c.b.String())
+}
@@ -1,20 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"embed"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -27,42 +43,270 @@ const (
 	PORT       = ":8080"
 	URL        = "http://localhost" + PORT
 	STATIC_DIR = "./static"
+
+	SESSION_TTL = 12 * time.Hour // Vigencia de un token desde el login
+
+	TIMESTAMP_LAYOUT = "2006-01-02 15:04:05"
+
+	PASSWORD_SCHEME     = "pbkdf2_sha256"
+	PASSWORD_ITERATIONS = 100000
+	DEFAULT_PASSWORD    = "1234" // Contraseña de las cuentas semilla
+
+	// Alcance del token: completo, o restringido al cambio de contraseña obligatorio
+	SCOPE_FULL            = "full"
+	SCOPE_PASSWORD_CHANGE = "password_change"
+)
+
+// LoginThrottle : Límite de intentos fallidos para una clase de llave (cuenta o IP)
+type LoginThrottle struct {
+	Kind        string
+	MaxFailures int           // Fallos consecutivos antes del bloqueo temporal
+	Lockout     time.Duration // Duración del bloqueo
+}
+
+var (
+	throttleAccount = LoginThrottle{Kind: "user", MaxFailures: 5, Lockout: 15 * time.Minute}
+	throttleIP      = LoginThrottle{Kind: "ip", MaxFailures: 20, Lockout: 15 * time.Minute}
+	loginMu         sync.Mutex
 )
 
+const (
+	LOGIN_BACKOFF_BASE = 1 * time.Second  // Espera tras el primer fallo; se duplica con cada fallo
+	LOGIN_BACKOFF_MAX  = 60 * time.Second
+)
+
+// PasswordPolicy : Requisitos mínimos de contraseña (ajustables por variables de entorno)
+type PasswordPolicy struct {
+	MinLength  int // SART_PASSWORD_MIN_LENGTH
+	MinClasses int // SART_PASSWORD_MIN_CLASSES: minúsculas, mayúsculas, dígitos, símbolos
+}
+
+var passwordPolicy = PasswordPolicy{MinLength: 8, MinClasses: 3}
+
+// Rutas que acepta un token restringido (SCOPE_PASSWORD_CHANGE)
+var passwordChangeRoutes = map[string]bool{
+	"/api/users/me/password": true,
+	"/api/logout":            true,
+}
+
 var db *sql.DB
 var lastHeartbeat = time.Now()
 //go:embed static/*
 var embeddedFiles embed.FS
 
+// --- PERMISOS POR ROL ---
+
+const (
+	ROLE_ADMIN  = "admin"
+	ROLE_VIEWER = "viewer"
+)
+
+var (
+	anyRole   = []string{ROLE_ADMIN, ROLE_VIEWER}
+	adminOnly = []string{ROLE_ADMIN}
+
+	// Catálogos e infraestructura: todos consultan, solo el administrador modifica
+	masterRules = map[string][]string{"GET": anyRole, "POST": adminOnly, "PUT": adminOnly, "DELETE": adminOnly}
+)
+
+// permissions : Tabla única de autorización (ruta -> método -> roles permitidos).
+// Toda ruta o método que no figure aquí se rechaza.
+var permissions = map[string]map[string][]string{
+	"/api/logout": {"POST": anyRole},
+	"/api/stats":  {"GET": anyRole},
+	"/api/stats/technicians": {"GET": anyRole},
+	"/api/users":  {"GET": anyRole, "POST": adminOnly, "PUT": adminOnly, "DELETE": adminOnly},
+
+	"/api/users/me":          {"GET": anyRole, "PUT": anyRole},
+	"/api/users/me/password": {"POST": anyRole},
+	"/api/users/unlock":      {"POST": adminOnly},
+
+	"/api/audit":         {"GET": adminOnly},
+	"/api/periods":         {"GET": anyRole, "POST": adminOnly, "PUT": adminOnly, "DELETE": adminOnly},
+	"/api/periods/current": {"GET": anyRole, "POST": adminOnly},
+	"/api/trash":         {"GET": adminOnly, "DELETE": adminOnly},
+	"/api/trash/restore": {"POST": adminOnly},
+
+	"/api/specs":     {"GET": anyRole},
+	"/api/locations": {"GET": anyRole},
+
+	"/api/devices": {"GET": anyRole, "POST": adminOnly, "PUT": adminOnly, "DELETE": adminOnly},
+	"/api/devices/import": {"POST": adminOnly},
+	"/api/devices/export": {"GET": anyRole},
+	"/api/devices/labels": {"GET": anyRole},
+	"/api/devices/": {"GET": anyRole}, // /api/devices/{id}/history y /api/devices/{id}/changes
+	"/api/reports/moves": {"GET": anyRole},
+	"/api/tickets": {"GET": anyRole, "POST": anyRole, "PUT": adminOnly, "DELETE": adminOnly},
+	"/api/tickets/transitions": {"GET": anyRole},
+	"/api/tickets/reopen":      {"POST": adminOnly},
+	"/api/tickets/notes":       {"GET": anyRole, "POST": anyRole},
+	"/api/tickets/parts":       {"GET": anyRole, "POST": anyRole, "DELETE": adminOnly},
+	"/api/tickets/":            {"GET": anyRole}, // /api/tickets/{id}/receipt.pdf
+	"/api/reports/parts":       {"GET": anyRole},
+	"/api/reports/tickets.pdf": {"GET": anyRole},
+
+	"/api/settings":      {"GET": anyRole, "PUT": adminOnly},
+	"/api/settings/logo": {"GET": anyRole, "POST": adminOnly, "DELETE": adminOnly},
+
+	"/api/data/types":           masterRules,
+	"/api/data/os":              masterRules,
+	"/api/data/rams":            masterRules,
+	"/api/data/storages":        masterRules,
+	"/api/data/parts":           masterRules,
+	"/api/data/processors":      masterRules,
+	"/api/data/brands":          masterRules,
+	"/api/data/models":          masterRules,
+	"/api/data/buildings_infra": masterRules,
+	"/api/data/floors":          masterRules,
+	"/api/data/areas":           masterRules,
+	"/api/data/rooms":           masterRules,
+	"/api/data/locations":       {"GET": anyRole, "PUT": adminOnly, "DELETE": adminOnly},
+}
+
+// --- PAPELERA (BORRADO LÓGICO) ---
+
+// trashTables : Tablas con borrado lógico, por el mismo nombre que usan sus endpoints
+var trashTables = map[string]TrashTable{
+	"devices":         {"Dispositivo", "(SELECT type FROM Tipo WHERE id = x.id_type) || ' ' || COALESCE(x.code, x.serial, '#' || x.id)"},
+	"tickets":         {"Taller", "'Ticket #' || x.id || ' (' || x.date_in || ') ' || COALESCE(x.details_in, '')"},
+	"types":           {"Tipo", "x.type"},
+	"os":              {"Sistema_Operativo", "x.os"},
+	"rams":            {"RAM", "x.ram"},
+	"storages":        {"Almacenamiento", "x.storage"},
+	"processors":      {"Procesador", "x.processor"},
+	"brands":          {"Marca", "x.brand"},
+	"models":          {"Modelo", "(SELECT brand FROM Marca WHERE id = x.id_brand) || ' ' || x.model"},
+	"buildings_infra": {"Edificio", "x.building"},
+	"floors":          {"Piso", "(SELECT building FROM Edificio WHERE id = x.id_building) || ' > ' || x.floor"},
+	"areas":           {"Area", "x.area"},
+	"rooms":           {"Departamento", "(SELECT area FROM Area WHERE id = x.id_area) || ' > ' || x.room"},
+	"locations":       {"Ubicacion", "(SELECT area FROM Area WHERE id = x.id_area) || COALESCE(' > ' || (SELECT room FROM Departamento WHERE id = x.id_room), '')"},
+	"parts":           {"Repuesto", "x.part"},
+}
+
+var trashTableOrder = []string{"devices", "tickets", "types", "os", "rams", "storages", "processors", "brands", "models", "buildings_infra", "floors", "areas", "rooms", "locations", "parts"}
+
+// trashRelations : Referencias hijo -> padre que se validan al restaurar (padre activo)
+// y al purgar (sin hijos, ni siquiera en la papelera)
+var trashRelations = []struct{ Child, Column, Parent string }{
+	{"Dispositivo", "id_type", "Tipo"},
+	{"Dispositivo", "id_location", "Ubicacion"},
+	{"Dispositivo", "id_os", "Sistema_Operativo"},
+	{"Dispositivo", "id_ram", "RAM"},
+	{"Dispositivo", "id_storage", "Almacenamiento"},
+	{"Dispositivo", "id_processor", "Procesador"},
+	{"Dispositivo", "id_brand", "Marca"},
+	{"Dispositivo", "id_model", "Modelo"},
+	{"Taller", "id_device", "Dispositivo"},
+	{"Modelo", "id_brand", "Marca"},
+	{"Piso", "id_building", "Edificio"},
+	{"Area", "id_floor", "Piso"},
+	{"Departamento", "id_area", "Area"},
+	{"Ubicacion", "id_area", "Area"},
+	{"Ubicacion", "id_room", "Departamento"},
+	{"Taller_Repuesto", "id_part", "Repuesto"},
+}
+
+// trashOwned : Filas dependientes que se purgan junto con su registro (no tienen papelera propia)
+var trashOwned = map[string][]struct{ Table, Column string }{
+	"Taller":      {{"Taller_Estado", "id_ticket"}, {"Taller_Nota", "id_ticket"}, {"Taller_Repuesto", "id_ticket"}},
+	"Dispositivo": {{"Dispositivo_Historial", "id_device"}},
+}
+
+// activeUniqueIndexes : Unicidad solo entre registros activos, para que lo que está en la papelera
+// no impida volver a crear el mismo nombre
+var activeUniqueIndexes = []struct{ Name, Table, Columns string }{
+	{"uq_edificio_building", "Edificio", "building"},
+	{"uq_piso_floor", "Piso", "id_building, floor"},
+	{"uq_area_area", "Area", "id_floor, area"},
+	{"uq_departamento_room", "Departamento", "id_area, room"},
+	{"uq_tipo_type", "Tipo", "type"},
+	{"uq_ubicacion", "Ubicacion", "id_area, id_room, details"},
+	{"uq_repuesto_part", "Repuesto", "part"},
+	{"uq_marca_brand", "Marca", "brand"},
+	{"uq_modelo_model", "Modelo", "id_brand, model"},
+	{"uq_dispositivo_code", "Dispositivo", "code"},
+	{"uq_taller_ticket", "Taller", "id_device, status, date_in, details_in"},
+}
+
 // --- ESTRUCTURAS GENERALES ---
 
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
-	Role     string `json:"role"`
+	// Obsoleto: el rol lo determina el servidor desde Usuario.rol. Se acepta y se ignora
+	// para no romper clientes anteriores que aún envían el selector de rol.
+	Role string `json:"role,omitempty"`
 }
 
 type UserResponse struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
-	FullName string `json:"full_name"`
-	Role     string `json:"role"`
-	Token    string `json:"token"`
+	ID                 int    `json:"id"`
+	Username           string `json:"username"`
+	FullName           string `json:"full_name"`
+	Role               string `json:"role"`
+	Token              string `json:"token"`
+	MustChangePassword bool   `json:"must_change_password"`
+}
+
+// SessionUser : Usuario autenticado resuelto por middlewareAuth a partir del token
+type SessionUser struct {
+	ID       int
+	Username string
+	Role     string
+	Token    string
+	Scope    string
 }
 
+type ctxKey string
+
+const ctxSessionUser ctxKey = "session_user"
+
 type User struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
-	Password string `json:"password,omitempty"`
-	FullName string `json:"full_name"`
-	Position string `json:"position"`
-	Role     string `json:"role"`
+	ID                 int    `json:"id"`
+	Username           string `json:"username"`
+	Password           string `json:"password,omitempty"`
+	FullName           string `json:"full_name"`
+	Position           string `json:"position"`
+	Role               string `json:"role"`
+	MustChangePassword bool   `json:"must_change_password"`
+	Locked             bool   `json:"locked"`
+}
+
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ProfileUpdateRequest : Datos editables por el propio usuario en /api/users/me
+type ProfileUpdateRequest struct {
+	FullName        string  `json:"full_name"`
+	Position        string  `json:"position"`
+	Role            *string `json:"role"` // Solo para rechazar intentos de cambiar el propio rol
+	CurrentPassword string  `json:"current_password"`
+	NewPassword     string  `json:"new_password"`
+}
+
+// Period : Período académico (tabla Periodo)
+type Period struct {
+	Code      string `json:"code"`
+	DateIni   string `json:"date_ini"`
+	DateEnd   string `json:"date_end"`
+	IsCurrent bool   `json:"is_current"`
 }
 
 type StatsResponse struct {
 	InWorkshop     int `json:"in_workshop"`
 	Repaired       int `json:"repaired"`
 	TotalThisMonth int `json:"total_month"`
+
+	// Indicadores del período (vacíos si no hay períodos registrados)
+	Period           *Period `json:"period"`
+	Opened           int     `json:"opened"`
+	ClosedRepaired   int     `json:"closed_repaired"`
+	ClosedUnrepaired int     `json:"closed_unrepaired"`
+	DaysTotal        int     `json:"days_total"`
+	DaysElapsed      int     `json:"days_elapsed"`
+	ElapsedPercent   float64 `json:"elapsed_percent"`
 }
 
 type SelectItem struct {
@@ -79,6 +323,7 @@ type SpecsResponse struct {
 	RAMs          []SelectItem `json:"rams"`
 	Storages      []SelectItem `json:"storages"`
 	Processors    []SelectItem `json:"processors"`
+	Parts         []SelectItem `json:"parts"`
 	Architectures []SelectItem `json:"architectures"`
 }
 
@@ -115,6 +360,40 @@ type Device struct {
 	StatusLabel string  `json:"status_label"`
 }
 
+// DeviceChange : Cambio de ubicación o de especificación de un equipo (Dispositivo_Historial)
+type DeviceChange struct {
+	DeviceID int     `json:"id_device"`
+	Date     string  `json:"date"`
+	Username *string `json:"username"`
+	Field    string  `json:"field"`
+	Label    string  `json:"label"`
+	OldValue *string `json:"old_value"`
+	NewValue *string `json:"new_value"`
+}
+
+// DeviceMove : Traslado de un equipo para el reporte de movimientos
+type DeviceMove struct {
+	DeviceChange
+	DeviceType *string `json:"device_type"`
+	Code       *string `json:"code"`
+	Serial     *string `json:"serial"`
+}
+
+// DeviceHistory : Hoja de Vida de un equipo
+type DeviceHistory struct {
+	Device          Device         `json:"device"`
+	Tickets         []Ticket       `json:"tickets"`
+	LocationChanges []DeviceChange `json:"location_changes"`
+	SpecChanges     []DeviceChange `json:"spec_changes"`
+	Totals          struct {
+		Tickets        int `json:"tickets"`
+		Repaired       int `json:"repaired"`
+		Unrepaired     int `json:"unrepaired"`
+		Open           int `json:"open"`
+		DaysInWorkshop int `json:"days_in_workshop"`
+	} `json:"totals"`
+}
+
 type DeviceResponse struct {
 	Data  []Device `json:"data"`
 	Total int      `json:"total"`
@@ -144,6 +423,77 @@ type Ticket struct {
 	Status        string  `json:"status"`
 	DateOut       *string `json:"date_out"`
 	DetailsOut    *string `json:"details_out"`
+	LastNote      *string `json:"last_note"`
+	LastNoteAt    *string `json:"last_note_at"`
+	ReceivedBy    *int    `json:"received_by"`
+	ReceivedName  *string `json:"received_by_name"`
+	AssignedTo    *int    `json:"assigned_to"`
+	AssignedName  *string `json:"assigned_to_name"`
+}
+
+// TicketNote : Entrada de la bitácora de trabajo de un ticket (Taller_Nota)
+type TicketNote struct {
+	ID        int     `json:"id"`
+	TicketID  int     `json:"id_ticket"`
+	UserID    *int    `json:"id_user"`
+	Author    *string `json:"author"`
+	CreatedAt string  `json:"created_at"`
+	Note      string  `json:"note"`
+}
+
+// TicketPart : Repuesto usado en un ticket (Taller_Repuesto)
+type TicketPart struct {
+	ID              int     `json:"id"`
+	TicketID        int     `json:"id_ticket"`
+	PartID          int     `json:"id_part"`
+	Part            string  `json:"part"`
+	Quantity        int     `json:"quantity"`
+	SerialRemoved   *string `json:"serial_removed"`
+	SerialInstalled *string `json:"serial_installed"`
+	Author          *string `json:"author"`
+	CreatedAt       string  `json:"created_at"`
+}
+
+// TicketPartRequest : Alta de un repuesto en un ticket. IDRAM/IDStorage actualizan la ficha del equipo.
+type TicketPartRequest struct {
+	PartID          int     `json:"id_part"`
+	Quantity        int     `json:"quantity"`
+	SerialRemoved   string  `json:"serial_removed"`
+	SerialInstalled string  `json:"serial_installed"`
+	IDRAM           *int    `json:"id_ram"`
+	IDStorage       *int    `json:"id_storage"`
+}
+
+// PartUsage : Fila del reporte de repuestos consumidos
+type PartUsage struct {
+	PartID   int    `json:"id_part"`
+	Part     string `json:"part"`
+	Quantity int    `json:"quantity"`
+	Tickets  int    `json:"tickets"`
+}
+
+// TechnicianStats : Carga de trabajo por técnico (tickets asignados)
+type TechnicianStats struct {
+	ID            int      `json:"id"`
+	Username      string   `json:"username"`
+	FullName      string   `json:"full_name"`
+	Open          int      `json:"open"`
+	Repaired      int      `json:"repaired"`
+	Unrepaired    int      `json:"unrepaired"`
+	Closed        int      `json:"closed"`
+	AvgRepairDays *float64 `json:"avg_repair_days"`
+}
+
+// TicketTransition : Cambio de estado de un ticket (Taller_Estado). Al reabrir conserva el cierre anterior.
+type TicketTransition struct {
+	ID         int     `json:"id"`
+	FromStatus *string `json:"from_status"`
+	ToStatus   string  `json:"to_status"`
+	DateOut    *string `json:"date_out"`
+	DetailsOut *string `json:"details_out"`
+	Reason     *string `json:"reason"`
+	Username   *string `json:"username"`
+	CreatedAt  string  `json:"created_at"`
 }
 
 type TicketResponse struct {
@@ -153,6 +503,46 @@ type TicketResponse struct {
 	Limit int      `json:"limit"`
 }
 
+// AuditEntry : Registro de Auditoria con el estado anterior/posterior en JSON
+type AuditEntry struct {
+	ID        int             `json:"id"`
+	UserID    *int            `json:"id_user"`
+	Username  *string         `json:"username"`
+	CreatedAt string          `json:"created_at"`
+	Entity    string          `json:"entity"`
+	EntityID  interface{}     `json:"entity_id"` // Entero, o texto para claves como Periodo.code
+	Action    string          `json:"action"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+}
+
+type AuditResponse struct {
+	Data  []AuditEntry `json:"data"`
+	Total int          `json:"total"`
+	Page  int          `json:"page"`
+	Limit int          `json:"limit"`
+}
+
+// TrashTable : Tabla con papelera (deleted_at) y la expresión usada para describir sus filas
+type TrashTable struct {
+	Table string
+	Label string // SQL sobre el alias x
+}
+
+type TrashItem struct {
+	Table     string `json:"table"`
+	ID        int    `json:"id"`
+	Value     string `json:"value"`
+	DeletedAt string `json:"deleted_at"`
+}
+
+type TrashResponse struct {
+	Data  []TrashItem `json:"data"`
+	Total int         `json:"total"`
+	Page  int         `json:"page"`
+	Limit int         `json:"limit"`
+}
+
 // Estructura para CRUD de Tablas Maestras
 type MasterItem struct {
 	ID       int         `json:"id"`
@@ -172,6 +562,7 @@ type MasterResponse struct {
 func main() {
 	logFile := initLogger()
 	defer logFile.Close()
+	loadPasswordPolicy()
 	
 	initDB()
 	defer db.Close()
@@ -187,34 +578,59 @@ func main() {
 
 	// Auth & Core
 	http.HandleFunc("/api/login", handleLogin)
-	http.HandleFunc("/api/stats", middlewareAuth(handleStats))
-	http.HandleFunc("/api/users", middlewareAuth(handleUsersCRUD))
+	http.HandleFunc("/api/logout", secure("/api/logout", handleLogout))
+	http.HandleFunc("/api/stats", secure("/api/stats", handleStats))
+	http.HandleFunc("/api/stats/technicians", secure("/api/stats/technicians", handleTechnicianStats))
+	http.HandleFunc("/api/users", secure("/api/users", handleUsersCRUD))
+	http.HandleFunc("/api/users/me", secure("/api/users/me", handleOwnProfile))
+	http.HandleFunc("/api/users/me/password", secure("/api/users/me/password", handleChangeOwnPassword))
+	http.HandleFunc("/api/users/unlock", secure("/api/users/unlock", handleUnlockUser))
+	http.HandleFunc("/api/audit", secure("/api/audit", handleAudit))
+	http.HandleFunc("/api/periods", secure("/api/periods", handlePeriodsCRUD))
+	http.HandleFunc("/api/periods/current", secure("/api/periods/current", handleCurrentPeriod))
+	http.HandleFunc("/api/trash", secure("/api/trash", handleTrash))
+	http.HandleFunc("/api/trash/restore", secure("/api/trash/restore", handleTrashRestore))
 
 	// Selectores
-	http.HandleFunc("/api/specs", middlewareAuth(handleSpecs))
-	http.HandleFunc("/api/locations", middlewareAuth(handleLocations))
+	http.HandleFunc("/api/specs", secure("/api/specs", handleSpecs))
+	http.HandleFunc("/api/locations", secure("/api/locations", handleLocations))
 
 	// Módulos Principales
-	http.HandleFunc("/api/devices", middlewareAuth(handleDevicesCRUD))
-	http.HandleFunc("/api/tickets", middlewareAuth(handleTicketsCRUD))
+	http.HandleFunc("/api/devices", secure("/api/devices", handleDevicesCRUD))
+	http.HandleFunc("/api/devices/import", secure("/api/devices/import", handleDeviceImport))
+	http.HandleFunc("/api/devices/export", secure("/api/devices/export", handleDeviceExport))
+	http.HandleFunc("/api/devices/labels", secure("/api/devices/labels", handleDeviceLabels))
+	http.HandleFunc("/api/devices/", secure("/api/devices/", handleDeviceSubroutes))
+	http.HandleFunc("/api/tickets", secure("/api/tickets", handleTicketsCRUD))
+	http.HandleFunc("/api/tickets/transitions", secure("/api/tickets/transitions", handleTicketTransitions))
+	http.HandleFunc("/api/tickets/reopen", secure("/api/tickets/reopen", handleTicketReopen))
+	http.HandleFunc("/api/tickets/notes", secure("/api/tickets/notes", handleTicketNotes))
+	http.HandleFunc("/api/tickets/parts", secure("/api/tickets/parts", handleTicketParts))
+	http.HandleFunc("/api/tickets/", secure("/api/tickets/", handleTicketSubroutes))
+	http.HandleFunc("/api/reports/parts", secure("/api/reports/parts", handlePartsReport))
+	http.HandleFunc("/api/reports/moves", secure("/api/reports/moves", handleMovesReport))
+	http.HandleFunc("/api/reports/tickets.pdf", secure("/api/reports/tickets.pdf", handleTicketsReportPDF))
+	http.HandleFunc("/api/settings", secure("/api/settings", handleSettings))
+	http.HandleFunc("/api/settings/logo", secure("/api/settings/logo", handleSettingsLogo))
 
 	// --- GESTIÓN DE DATOS (CATÁLOGOS) ---
-	http.HandleFunc("/api/data/types", middlewareAuth(makeSimpleMasterHandler("Tipo", "type", "id_type")))
-	http.HandleFunc("/api/data/os", middlewareAuth(makeSimpleMasterHandler("Sistema_Operativo", "os", "id_os")))
-	http.HandleFunc("/api/data/rams", middlewareAuth(makeSimpleMasterHandler("RAM", "ram", "id_ram")))
-	http.HandleFunc("/api/data/storages", middlewareAuth(makeSimpleMasterHandler("Almacenamiento", "storage", "id_storage")))
-	http.HandleFunc("/api/data/processors", middlewareAuth(makeSimpleMasterHandler("Procesador", "processor", "id_processor")))
-	http.HandleFunc("/api/data/brands", middlewareAuth(makeSimpleMasterHandler("Marca", "brand", "id_brand")))
-	http.HandleFunc("/api/data/models", middlewareAuth(handleModelMasterCRUD))
+	http.HandleFunc("/api/data/types", secure("/api/data/types", makeSimpleMasterHandler("Tipo", "type", "id_type")))
+	http.HandleFunc("/api/data/os", secure("/api/data/os", makeSimpleMasterHandler("Sistema_Operativo", "os", "id_os")))
+	http.HandleFunc("/api/data/rams", secure("/api/data/rams", makeSimpleMasterHandler("RAM", "ram", "id_ram")))
+	http.HandleFunc("/api/data/storages", secure("/api/data/storages", makeSimpleMasterHandler("Almacenamiento", "storage", "id_storage")))
+	http.HandleFunc("/api/data/parts", secure("/api/data/parts", makeSimpleMasterHandler("Repuesto", "part", "")))
+	http.HandleFunc("/api/data/processors", secure("/api/data/processors", makeSimpleMasterHandler("Procesador", "processor", "id_processor")))
+	http.HandleFunc("/api/data/brands", secure("/api/data/brands", makeSimpleMasterHandler("Marca", "brand", "id_brand")))
+	http.HandleFunc("/api/data/models", secure("/api/data/models", handleModelMasterCRUD))
 
 	// --- GESTIÓN DE DATOS (INFRAESTRUCTURA) ---
-	http.HandleFunc("/api/data/buildings_infra", middlewareAuth(handleBuildingMasterCRUD))
-	http.HandleFunc("/api/data/floors", middlewareAuth(handleFloorMasterCRUD))
-	http.HandleFunc("/api/data/areas", middlewareAuth(handleAreaMasterCRUD))
-	http.HandleFunc("/api/data/rooms", middlewareAuth(handleRoomMasterCRUD))
+	http.HandleFunc("/api/data/buildings_infra", secure("/api/data/buildings_infra", handleBuildingMasterCRUD))
+	http.HandleFunc("/api/data/floors", secure("/api/data/floors", handleFloorMasterCRUD))
+	http.HandleFunc("/api/data/areas", secure("/api/data/areas", handleAreaMasterCRUD))
+	http.HandleFunc("/api/data/rooms", secure("/api/data/rooms", handleRoomMasterCRUD))
 	
 	// Vista de Ubicaciones (Links - Solo Lectura/Edición Detalles)
-	http.HandleFunc("/api/data/locations", middlewareAuth(handleLocationMasterCRUD))
+	http.HandleFunc("/api/data/locations", secure("/api/data/locations", handleLocationMasterCRUD))
 	
 	// Fallback SPA leyendo desde la memoria
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -310,6 +726,9 @@ func initDB() {
 		seedData()
 	}
 
+	migratePlaintextPasswords()
+	migrateSchema()
+
 	createTriggers()
 	createViews()
 }
@@ -322,7 +741,41 @@ func createTables() {
 		password TEXT NOT NULL,
 		full_name TEXT NOT NULL,
 		position TEXT,
-		rol TEXT CHECK(rol IN ('admin', 'viewer')) DEFAULT 'viewer'
+		rol TEXT CHECK(rol IN ('admin', 'viewer')) DEFAULT 'viewer',
+		must_change_password INTEGER CHECK(must_change_password IN (0, 1)) DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS Sesion (
+		token TEXT PRIMARY KEY,
+		id_user INTEGER NOT NULL,
+		scope TEXT CHECK(scope IN ('full', 'password_change')) DEFAULT 'full',
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		FOREIGN KEY (id_user) REFERENCES Usuario(id) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS Auditoria (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		id_user INTEGER,
+		username TEXT,
+		created_at TEXT NOT NULL,
+		entity TEXT NOT NULL,
+		entity_id INTEGER,
+		action TEXT NOT NULL,
+		before_data TEXT,
+		after_data TEXT,
+		FOREIGN KEY (id_user) REFERENCES Usuario(id) ON DELETE SET NULL ON UPDATE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_auditoria_entity ON Auditoria(entity, entity_id);
+
+	CREATE TABLE IF NOT EXISTS Intento_Acceso (
+		kind TEXT CHECK(kind IN ('user', 'ip')) NOT NULL,
+		subject TEXT NOT NULL,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_failure INTEGER NOT NULL DEFAULT 0,
+		locked_until INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (kind, subject)
 	);
 
 	CREATE TABLE IF NOT EXISTS Periodo (
@@ -333,16 +786,21 @@ func createTables() {
 		CONSTRAINT valid_range CHECK (date_ini < date_end)
 	);
 
+	CREATE TABLE IF NOT EXISTS Configuracion (
+		setting TEXT PRIMARY KEY,
+		value TEXT,
+		updated_at TEXT
+	);
+
 	CREATE TABLE IF NOT EXISTS Edificio (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		building TEXT UNIQUE NOT NULL
+		building TEXT NOT NULL
 	);
 
 	CREATE TABLE IF NOT EXISTS Piso (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		id_building INTEGER NOT NULL,
 		floor TEXT NOT NULL,
-		UNIQUE(id_building, floor),
 		FOREIGN KEY (id_building) REFERENCES Edificio(id) ON DELETE CASCADE ON UPDATE CASCADE
 	);
 
@@ -350,7 +808,6 @@ func createTables() {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		id_floor INTEGER NOT NULL,
 		area TEXT NOT NULL,
-		UNIQUE(id_floor, area),
 		FOREIGN KEY (id_floor) REFERENCES Piso(id) ON DELETE CASCADE ON UPDATE CASCADE
 	);
 
@@ -358,13 +815,12 @@ func createTables() {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		id_area INTEGER NOT NULL,
 		room TEXT NOT NULL,
-		UNIQUE(id_area, room),
 		FOREIGN KEY (id_area) REFERENCES Area(id) ON DELETE CASCADE ON UPDATE CASCADE
 	);
 
 	CREATE TABLE IF NOT EXISTS Tipo (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		type TEXT NOT NULL UNIQUE
+		type TEXT NOT NULL
 	);
 
 	CREATE TABLE IF NOT EXISTS Ubicacion (
@@ -372,7 +828,6 @@ func createTables() {
 		id_area INTEGER NOT NULL,
 		id_room INTEGER,
 		details TEXT,
-		UNIQUE(id_area, id_room, details),
 		FOREIGN KEY (id_area) REFERENCES Area(id) ON DELETE RESTRICT ON UPDATE CASCADE,
 		FOREIGN KEY (id_room) REFERENCES Departamento(id) ON DELETE RESTRICT ON UPDATE CASCADE
 	);
@@ -397,22 +852,26 @@ func createTables() {
 		processor TEXT
 	);
 
+	CREATE TABLE IF NOT EXISTS Repuesto (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		part TEXT NOT NULL
+	);
+
 	CREATE TABLE IF NOT EXISTS Marca (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		brand TEXT UNIQUE NOT NULL
+		brand TEXT NOT NULL
 	);
 
 	CREATE TABLE IF NOT EXISTS Modelo (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		id_brand INTEGER NOT NULL,
 		model TEXT NOT NULL,
-		UNIQUE(id_brand, model),
 		FOREIGN KEY (id_brand) REFERENCES Marca(id) ON DELETE CASCADE ON UPDATE CASCADE
 	);
 
 	CREATE TABLE IF NOT EXISTS Dispositivo (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		code TEXT UNIQUE,
+		code TEXT,
 		id_type INTEGER NOT NULL,
 		id_location INTEGER NOT NULL,
 		id_os INTEGER,
@@ -435,6 +894,20 @@ func createTables() {
 		CONSTRAINT check_brand_model_required CHECK (id_model IS NULL OR (id_model IS NOT NULL AND id_brand IS NOT NULL))
 	);
 
+	CREATE TABLE IF NOT EXISTS Dispositivo_Historial (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		id_device INTEGER NOT NULL,
+		field TEXT NOT NULL,
+		old_value TEXT,
+		new_value TEXT,
+		id_user INTEGER,
+		username TEXT,
+		changed_at TEXT NOT NULL,
+		FOREIGN KEY (id_device) REFERENCES Dispositivo(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		FOREIGN KEY (id_user) REFERENCES Usuario(id) ON DELETE SET NULL ON UPDATE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_dispositivo_historial ON Dispositivo_Historial(id_device, field);
+
 	CREATE TABLE IF NOT EXISTS Taller (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		id_device INTEGER NOT NULL, 
@@ -443,14 +916,187 @@ func createTables() {
 		date_out TEXT CHECK(date_out IS date(date_out)),
 		details_in TEXT,
 		details_out TEXT,
-		UNIQUE(id_device, status, date_in, details_in),
 		FOREIGN KEY (id_device) REFERENCES Dispositivo(id) ON DELETE NO ACTION ON UPDATE CASCADE,
 		CONSTRAINT check_dates CHECK (date_out IS NULL OR date_out >= date_in)
 	);
+
+	CREATE TABLE IF NOT EXISTS Taller_Estado (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		id_ticket INTEGER NOT NULL,
+		from_status TEXT,
+		to_status TEXT NOT NULL CHECK(to_status IN ('repaired', 'pending', 'unrepaired')),
+		date_out TEXT,
+		details_out TEXT,
+		reason TEXT,
+		id_user INTEGER,
+		created_at TEXT NOT NULL,
+		FOREIGN KEY (id_ticket) REFERENCES Taller(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		FOREIGN KEY (id_user) REFERENCES Usuario(id) ON DELETE SET NULL ON UPDATE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_taller_estado_ticket ON Taller_Estado(id_ticket);
+
+	CREATE TABLE IF NOT EXISTS Taller_Nota (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		id_ticket INTEGER NOT NULL,
+		id_user INTEGER,
+		created_at TEXT NOT NULL,
+		note TEXT NOT NULL CHECK(length(trim(note)) > 0),
+		FOREIGN KEY (id_ticket) REFERENCES Taller(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		FOREIGN KEY (id_user) REFERENCES Usuario(id) ON DELETE SET NULL ON UPDATE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_taller_nota_ticket ON Taller_Nota(id_ticket);
+
+	CREATE TABLE IF NOT EXISTS Taller_Repuesto (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		id_ticket INTEGER NOT NULL,
+		id_part INTEGER NOT NULL,
+		quantity INTEGER NOT NULL DEFAULT 1 CHECK(quantity > 0),
+		serial_removed TEXT,
+		serial_installed TEXT,
+		id_user INTEGER,
+		created_at TEXT NOT NULL,
+		FOREIGN KEY (id_ticket) REFERENCES Taller(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		FOREIGN KEY (id_part) REFERENCES Repuesto(id) ON DELETE RESTRICT ON UPDATE CASCADE,
+		FOREIGN KEY (id_user) REFERENCES Usuario(id) ON DELETE SET NULL ON UPDATE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_taller_repuesto_ticket ON Taller_Repuesto(id_ticket);
 	`
 	db.Exec(schema)
 }
 
+// migrateSchema : Agrega a bases de datos existentes las columnas de versiones posteriores
+func migrateSchema() {
+	if addColumnIfMissing("Usuario", "must_change_password", "INTEGER CHECK(must_change_password IN (0, 1)) DEFAULT 0") {
+		flagDefaultPasswords()
+	}
+	addColumnIfMissing("Sesion", "scope", "TEXT CHECK(scope IN ('full', 'password_change')) DEFAULT 'full'")
+	addColumnIfMissing("Taller", "received_by", "INTEGER REFERENCES Usuario(id) ON DELETE SET NULL")
+	addColumnIfMissing("Taller", "assigned_to", "INTEGER REFERENCES Usuario(id) ON DELETE SET NULL")
+
+	for _, t := range trashTableOrder {
+		addColumnIfMissing(trashTables[t].Table, "deleted_at", "TEXT")
+	}
+
+	// Las restricciones UNIQUE de versiones anteriores también contaban los registros de la papelera.
+	// Si la migración falla la tabla queda como estaba; sin restricciones previas no se arranca sin unicidad.
+	for _, t := range trashTableOrder {
+		table := trashTables[t].Table
+		if kept, err := migrateActiveUnique(table); err != nil {
+			if !kept { log.Fatalf("No se pudo asegurar la unicidad de %s (¿valores repetidos entre registros activos?): %v", table, err) }
+			log.Printf("Error migrando restricciones UNIQUE de %s (se conservan las anteriores): %v", table, err)
+		}
+	}
+
+	// Un solo ticket pendiente por equipo. Si una base antigua ya tiene duplicados el índice no se crea,
+	// pero el POST de tickets lo sigue validando.
+	_, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_taller_pending_device ON Taller(id_device) WHERE status = 'pending' AND deleted_at IS NULL")
+	if err != nil {
+		log.Printf("No se pudo crear idx_taller_pending_device (¿equipos con más de un ticket pendiente?): %v", err)
+	}
+
+	backfillDeviceHistory()
+}
+
+var (
+	uniqueTableConstraint  = regexp.MustCompile(`(?i),\s*UNIQUE\s*\([^)]*\)`)
+	uniqueColumnConstraint = regexp.MustCompile(`(?i)\s+UNIQUE\b`)
+)
+
+// migrateActiveUnique : Reemplaza las restricciones UNIQUE de la tabla por sus índices de activeUniqueIndexes.
+// SQLite no permite quitarlas con ALTER TABLE: la tabla se reconstruye conservando datos, índices, triggers y la
+// secuencia AUTOINCREMENT. Todo ocurre en una transacción; kept indica si la tabla aún tiene las restricciones anteriores.
+func migrateActiveUnique(table string) (kept bool, err error) {
+	var createSQL string
+	if err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&createSQL); err != nil { return false, err }
+	columns := createSQL[strings.Index(createSQL, "("):]
+	stripped := uniqueColumnConstraint.ReplaceAllString(uniqueTableConstraint.ReplaceAllString(columns, ""), "")
+	rebuild := stripped != columns
+
+	// Las llaves foráneas se desactivan por conexión y fuera de una transacción
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil { return rebuild, err }
+	defer conn.Close()
+	if rebuild {
+		if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil { return rebuild, err }
+		defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+		// Evita que el RENAME valide vistas y triggers de otras tablas que apuntan a la tabla reconstruida
+		if _, err := conn.ExecContext(ctx, "PRAGMA legacy_alter_table = ON"); err != nil { return rebuild, err }
+		defer conn.ExecContext(ctx, "PRAGMA legacy_alter_table = OFF")
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil { return rebuild, err }
+	defer tx.Rollback()
+
+	if rebuild {
+		extras := []string{}
+		rows, err := tx.Query("SELECT sql FROM sqlite_master WHERE type IN ('index', 'trigger') AND tbl_name = ? AND sql IS NOT NULL", table)
+		if err != nil { return rebuild, err }
+		for rows.Next() {
+			var s string
+			if rows.Scan(&s) == nil { extras = append(extras, s) }
+		}
+		rows.Close()
+		var seq sql.NullInt64
+		if err := tx.QueryRow("SELECT seq FROM sqlite_sequence WHERE name = ?", table).Scan(&seq); err != nil && err != sql.ErrNoRows { return rebuild, err }
+
+		tmp := table + "_migracion"
+		steps := []string{
+			fmt.Sprintf("CREATE TABLE %s %s", tmp, stripped),
+			fmt.Sprintf("INSERT INTO %s SELECT * FROM %s", tmp, table),
+			fmt.Sprintf("DROP TABLE %s", table),
+			fmt.Sprintf("ALTER TABLE %s RENAME TO %s", tmp, table),
+		}
+		for _, s := range append(steps, extras...) {
+			if _, err := tx.Exec(s); err != nil { return rebuild, err }
+		}
+		if seq.Valid {
+			if _, err := tx.Exec("UPDATE sqlite_sequence SET seq = ? WHERE name = ?", seq.Int64, table); err != nil { return rebuild, err }
+		}
+
+		var violations int
+		if err := tx.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM pragma_foreign_key_check('%s')", table)).Scan(&violations); err != nil { return rebuild, err }
+		if violations > 0 { return rebuild, fmt.Errorf("%d referencias inválidas tras reconstruir la tabla", violations) }
+	}
+
+	for _, u := range activeUniqueIndexes {
+		if u.Table != table { continue }
+		_, err := tx.Exec(fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s(%s) WHERE deleted_at IS NULL", u.Name, u.Table, u.Columns))
+		if err != nil { return rebuild, fmt.Errorf("%s: %v", u.Name, err) }
+	}
+	if err := tx.Commit(); err != nil { return rebuild, err }
+	if rebuild { log.Printf("Migración: restricciones UNIQUE de %s reemplazadas por índices de registros activos", table) }
+	return false, nil
+}
+
+// addColumnIfMissing : Devuelve true si la columna no existía y fue creada
+func addColumnIfMissing(table, column, definition string) bool {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		log.Printf("Error inspeccionando tabla %s: %v", table, err)
+		return false
+	}
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil { continue }
+		if name == column {
+			rows.Close()
+			return false
+		}
+	}
+	rows.Close()
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		log.Printf("Error agregando columna %s.%s: %v", table, column, err)
+		return false
+	}
+	log.Printf("Migración: columna %s.%s agregada", table, column)
+	return true
+}
+
 func createTriggers() {
 	triggers := `
 	CREATE TRIGGER IF NOT EXISTS validate_brand_model_match_ins
@@ -517,7 +1163,8 @@ func createViews() {
 	JOIN Area a ON ubi.id_area = a.id
 	JOIN Piso p ON a.id_floor = p.id
 	JOIN Edificio edf ON p.id_building = edf.id
-	LEFT JOIN Departamento hab ON ubi.id_room = hab.id;
+	LEFT JOIN Departamento hab ON ubi.id_room = hab.id
+	WHERE ubi.deleted_at IS NULL;
 	
 	CREATE VIEW Vista_Datos_Dispositivo_Completo AS
     SELECT 
@@ -564,7 +1211,8 @@ func createViews() {
 	LEFT JOIN Sistema_Operativo os ON d.id_os = os.id
     LEFT JOIN Procesador proc ON d.id_processor = proc.id
     LEFT JOIN RAM r ON d.id_ram = r.id
-    LEFT JOIN Almacenamiento sto ON d.id_storage = sto.id;
+    LEFT JOIN Almacenamiento sto ON d.id_storage = sto.id
+	WHERE d.deleted_at IS NULL;
 	`
 	if _, err := db.Exec(views); err != nil {
 		log.Printf("Error actualizando Vistas: %v", err)
@@ -575,8 +1223,8 @@ func seedData() {
 	seedSQL := `
 	BEGIN TRANSACTION;
 
-	INSERT OR IGNORE INTO Usuario (username, password, full_name, rol) VALUES ('admin', '1234', 'Admin SART', 'admin');
-	INSERT OR IGNORE INTO Usuario (username, password, full_name, rol) VALUES ('user', '1234', 'Consultor de Soporte', 'viewer');
+	INSERT OR IGNORE INTO Usuario (username, password, full_name, rol, must_change_password) VALUES ('admin', '1234', 'Admin SART', 'admin', 1);
+	INSERT OR IGNORE INTO Usuario (username, password, full_name, rol, must_change_password) VALUES ('user', '1234', 'Consultor de Soporte', 'viewer', 1);
 
 	-- ==========================================
 	-- 1. POBLAR TABLAS MAESTRAS (Catálogos)
@@ -852,6 +1500,12 @@ func handleDbError(w http.ResponseWriter, err error) {
 			respondError(w, 409, "Esta ubicación ya está registrada.")
 		} else if strings.Contains(msg, "Usuario.username") {
 			respondError(w, 409, "El nombre de usuario ya está en uso.")
+		} else if strings.Contains(msg, "Taller.id_device") && !strings.Contains(msg, "Taller.status") {
+			respondError(w, 409, "Este equipo ya tiene un ticket abierto en el taller.")
+		} else if strings.Contains(msg, "Repuesto.part") {
+			respondError(w, 409, "Ya existe ese repuesto.")
+		} else if strings.Contains(msg, "Periodo.code") {
+			respondError(w, 409, "Ya existe un período con ese código.")
 		} else {
 			respondError(w, 409, "Ya existe un registro con estos datos.")
 		}
@@ -866,29 +1520,230 @@ func handleDbError(w http.ResponseWriter, err error) {
 // --- HANDLERS AUTH & STATS ---
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { respondError(w, 405, "Método no permitido"); return }
 	var req LoginRequest
 	json.NewDecoder(r.Body).Decode(&req)
+	ip := clientIP(r)
+
+	if wait, locked := loginBlocked(throttleIP, ip); wait > 0 {
+		log.Printf("Login rechazado (IP en espera, bloqueo=%v): usuario=%q ip=%s", locked, req.Username, ip)
+		respondThrottled(w, wait, locked)
+		return
+	}
+	if wait, locked := loginBlocked(throttleAccount, req.Username); wait > 0 {
+		log.Printf("Login rechazado (cuenta en espera, bloqueo=%v): usuario=%q ip=%s", locked, req.Username, ip)
+		respondThrottled(w, wait, locked)
+		return
+	}
+
 	var user User
-	err := db.QueryRow("SELECT id, username, full_name, rol FROM Usuario WHERE username=? AND password=? AND rol=?", req.Username, req.Password, req.Role).Scan(&user.ID, &user.Username, &user.FullName, &user.Role)
+	var stored string
+	err := db.QueryRow("SELECT id, username, full_name, rol, password, must_change_password FROM Usuario WHERE username=?", req.Username).Scan(&user.ID, &user.Username, &user.FullName, &user.Role, &stored, &user.MustChangePassword)
 	if err != nil {
+		hashPassword(req.Password) // Igualar el tiempo de respuesta con un usuario existente
+	}
+	if err != nil || !verifyPassword(stored, req.Password) {
+		log.Printf("Login fallido: usuario=%q ip=%s", req.Username, ip)
+		registerLoginFailure(throttleAccount, req.Username)
+		registerLoginFailure(throttleIP, ip)
 		respondError(w, 401, "Credenciales inválidas")
 		return
 	}
-	respondJSON(w, UserResponse{ID: user.ID, Username: user.Username, FullName: user.FullName, Role: user.Role, Token: "mock-token-123"})
+	resetLoginFailures(throttleAccount, req.Username)
+	resetLoginFailures(throttleIP, ip)
+	scope := SCOPE_FULL
+	if user.MustChangePassword { scope = SCOPE_PASSWORD_CHANGE }
+	token, err := createSession(user.ID, scope)
+	if err != nil {
+		log.Printf("Error creando sesión: %v", err)
+		respondError(w, 500, "No se pudo iniciar la sesión.")
+		return
+	}
+	respondJSON(w, UserResponse{ID: user.ID, Username: user.Username, FullName: user.FullName, Role: user.Role, Token: token, MustChangePassword: user.MustChangePassword})
+}
+
+// handleUnlockUser : Desbloqueo manual de una cuenta por el administrador
+func handleUnlockUser(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" { respondError(w, 400, "ID requerido"); return }
+	var username string
+	if err := db.QueryRow("SELECT username FROM Usuario WHERE id = ?", id).Scan(&username); err != nil {
+		respondError(w, 404, "Usuario no encontrado")
+		return
+	}
+	resetLoginFailures(throttleAccount, username)
+	recordAudit(r, "Usuario", id, "unlock", nil, nil)
+	log.Printf("Cuenta desbloqueada: usuario=%q por=%q", username, currentUser(r).Username)
+	respondJSON(w, map[string]bool{"success": true})
+}
+
+// handleChangeOwnPassword : Cambio de contraseña del usuario de la sesión (obligatorio en el primer ingreso)
+func handleChangeOwnPassword(w http.ResponseWriter, r *http.Request) {
+	var req PasswordChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { respondError(w, 400, "JSON inválido"); return }
+	su := currentUser(r)
+	hash, ok := checkOwnPassword(w, su, req.CurrentPassword, req.NewPassword)
+	if !ok { return }
+
+	tx, err := db.Begin()
+	if err != nil { handleDbError(w, err); return }
+	defer tx.Rollback()
+	if err := applyOwnPassword(tx, su, hash); err != nil { handleDbError(w, err); return }
+	if err := tx.Commit(); err != nil { handleDbError(w, err); return }
+	recordAudit(r, "Usuario", su.ID, "password_change", nil, nil)
+	respondJSON(w, map[string]bool{"success": true})
+}
+
+// checkOwnPassword : Verifica la contraseña actual y la política, y devuelve el hash de la nueva. Responde el error y devuelve false si falla.
+func checkOwnPassword(w http.ResponseWriter, su *SessionUser, current, newPassword string) (string, bool) {
+	var stored string
+	if err := db.QueryRow("SELECT password FROM Usuario WHERE id = ?", su.ID).Scan(&stored); err != nil {
+		respondError(w, 404, "Usuario no encontrado")
+		return "", false
+	}
+	if !verifyPassword(stored, current) { respondError(w, 403, "La contraseña actual es incorrecta."); return "", false }
+	if newPassword == current { respondError(w, 400, "La nueva contraseña debe ser distinta a la actual."); return "", false }
+	if err := validatePasswordPolicy(newPassword); err != nil { respondError(w, 400, err.Error()); return "", false }
+
+	hash, err := hashPassword(newPassword)
+	if err != nil { respondError(w, 500, "Error procesando la contraseña"); return "", false }
+	return hash, true
+}
+
+// applyOwnPassword : Guarda la nueva contraseña, cierra las demás sesiones y habilita por completo la actual
+func applyOwnPassword(tx *sql.Tx, su *SessionUser, hash string) error {
+	if _, err := tx.Exec("UPDATE Usuario SET password=?, must_change_password=0 WHERE id=?", hash, su.ID); err != nil { return err }
+	if _, err := tx.Exec("DELETE FROM Sesion WHERE id_user = ? AND token != ?", su.ID, su.Token); err != nil { return err }
+	_, err := tx.Exec("UPDATE Sesion SET scope = ? WHERE token = ?", SCOPE_FULL, su.Token)
+	return err
+}
+
+// handleOwnProfile : Perfil del usuario de la sesión. Cualquier rol edita sus datos, nunca su rol.
+func handleOwnProfile(w http.ResponseWriter, r *http.Request) {
+	su := currentUser(r)
+	if r.Method == "GET" {
+		var u User
+		err := db.QueryRow("SELECT id, username, full_name, COALESCE(position, ''), rol, must_change_password FROM Usuario WHERE id = ?", su.ID).
+			Scan(&u.ID, &u.Username, &u.FullName, &u.Position, &u.Role, &u.MustChangePassword)
+		if err != nil { respondError(w, 404, "Usuario no encontrado"); return }
+		respondJSON(w, u)
+
+	} else if r.Method == "PUT" {
+		var req ProfileUpdateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil { respondError(w, 400, "JSON inválido"); return }
+		if req.Role != nil && *req.Role != su.Role {
+			respondError(w, 403, "No puede modificar su propio rol.")
+			return
+		}
+		req.FullName = strings.TrimSpace(req.FullName)
+		if req.FullName == "" { respondError(w, 400, "El nombre completo es obligatorio"); return }
+
+		hash := ""
+		if req.NewPassword != "" {
+			var ok bool
+			if hash, ok = checkOwnPassword(w, su, req.CurrentPassword, req.NewPassword); !ok { return }
+		}
+
+		before := snapshotRow("Usuario", su.ID)
+		tx, err := db.Begin()
+		if err != nil { handleDbError(w, err); return }
+		defer tx.Rollback()
+		if hash != "" {
+			if err := applyOwnPassword(tx, su, hash); err != nil { handleDbError(w, err); return }
+		}
+		if _, err := tx.Exec("UPDATE Usuario SET full_name=?, position=? WHERE id=?", req.FullName, strings.TrimSpace(req.Position), su.ID); err != nil {
+			handleDbError(w, err)
+			return
+		}
+		if err := tx.Commit(); err != nil { handleDbError(w, err); return }
+		if hash != "" { recordAudit(r, "Usuario", su.ID, "password_change", nil, nil) }
+		recordAudit(r, "Usuario", su.ID, "update", before, snapshotRow("Usuario", su.ID))
+		respondJSON(w, map[string]bool{"success": true})
+	}
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { respondError(w, 405, "Método no permitido"); return }
+	if su := currentUser(r); su != nil {
+		db.Exec("DELETE FROM Sesion WHERE token = ?", su.Token)
+	}
+	respondJSON(w, map[string]bool{"success": true})
 }
 
 func handleStats(w http.ResponseWriter, r *http.Request) {
 	stats := StatsResponse{}
-	db.QueryRow("SELECT COUNT(*) FROM Taller WHERE status IN ('pending', 'unrepaired')").Scan(&stats.InWorkshop)
-	db.QueryRow("SELECT COUNT(*) FROM Taller WHERE status = 'repaired'").Scan(&stats.Repaired)
+	db.QueryRow("SELECT COUNT(*) FROM Taller WHERE status IN ('pending', 'unrepaired') AND deleted_at IS NULL").Scan(&stats.InWorkshop)
+	db.QueryRow("SELECT COUNT(*) FROM Taller WHERE status = 'repaired' AND deleted_at IS NULL").Scan(&stats.Repaired)
 	currentMonth := time.Now().Format("2006-01")
-	db.QueryRow("SELECT COUNT(*) FROM Taller WHERE strftime('%Y-%m', date_in) = ?", currentMonth).Scan(&stats.TotalThisMonth)
+	db.QueryRow("SELECT COUNT(*) FROM Taller WHERE strftime('%Y-%m', date_in) = ? AND deleted_at IS NULL", currentMonth).Scan(&stats.TotalThisMonth)
+
+	// Período solicitado (?period=código) o, por defecto, el actual
+	var p Period
+	var err error
+	if code := r.URL.Query().Get("period"); code != "" {
+		err = db.QueryRow("SELECT code, date_ini, date_end, is_current FROM Periodo WHERE code = ?", code).Scan(&p.Code, &p.DateIni, &p.DateEnd, &p.IsCurrent)
+		if err == sql.ErrNoRows { respondError(w, 404, "Período no encontrado"); return }
+	} else {
+		p, err = currentPeriod()
+		if err == sql.ErrNoRows { respondJSON(w, stats); return }
+	}
+	if err != nil { handleDbError(w, err); return }
+
+	stats.Period = &p
+	db.QueryRow("SELECT COUNT(*) FROM Taller WHERE date_in BETWEEN ? AND ? AND deleted_at IS NULL", p.DateIni, p.DateEnd).Scan(&stats.Opened)
+	db.QueryRow("SELECT COUNT(*) FROM Taller WHERE status = 'repaired' AND date_out BETWEEN ? AND ? AND deleted_at IS NULL", p.DateIni, p.DateEnd).Scan(&stats.ClosedRepaired)
+	db.QueryRow("SELECT COUNT(*) FROM Taller WHERE status = 'unrepaired' AND date_out BETWEEN ? AND ? AND deleted_at IS NULL", p.DateIni, p.DateEnd).Scan(&stats.ClosedUnrepaired)
+
+	ini, _ := time.Parse("2006-01-02", p.DateIni)
+	end, _ := time.Parse("2006-01-02", p.DateEnd)
+	today, _ := time.Parse("2006-01-02", time.Now().Format("2006-01-02"))
+	stats.DaysTotal = int(end.Sub(ini).Hours()/24) + 1
+	stats.DaysElapsed = int(today.Sub(ini).Hours()/24) + 1
+	if stats.DaysElapsed < 0 { stats.DaysElapsed = 0 }
+	if stats.DaysElapsed > stats.DaysTotal { stats.DaysElapsed = stats.DaysTotal }
+	stats.ElapsedPercent = math.Round(float64(stats.DaysElapsed)*1000/float64(stats.DaysTotal)) / 10
 	respondJSON(w, stats)
 }
 
+// handleTechnicianStats : Tickets abiertos/cerrados y días promedio de reparación por técnico asignado.
+// Con ?period=código los cierres se limitan a ese período (los abiertos son siempre los actuales).
+func handleTechnicianStats(w http.ResponseWriter, r *http.Request) {
+	closedRange := ""
+	args := []interface{}{}
+	if code := r.URL.Query().Get("period"); code != "" {
+		var p Period
+		err := db.QueryRow("SELECT date_ini, date_end FROM Periodo WHERE code = ?", code).Scan(&p.DateIni, &p.DateEnd)
+		if err == sql.ErrNoRows { respondError(w, 404, "Período no encontrado"); return }
+		if err != nil { handleDbError(w, err); return }
+		closedRange = " AND t.date_out BETWEEN ? AND ? "
+		for i := 0; i < 4; i++ { args = append(args, p.DateIni, p.DateEnd) }
+	}
+
+	rows, err := db.Query(`SELECT u.id, u.username, u.full_name,
+			(SELECT COUNT(*) FROM Taller t WHERE t.assigned_to = u.id AND t.deleted_at IS NULL AND t.status = 'pending'),
+			(SELECT COUNT(*) FROM Taller t WHERE t.assigned_to = u.id AND t.deleted_at IS NULL AND t.status = 'repaired' `+closedRange+`),
+			(SELECT COUNT(*) FROM Taller t WHERE t.assigned_to = u.id AND t.deleted_at IS NULL AND t.status = 'unrepaired' `+closedRange+`),
+			(SELECT COUNT(*) FROM Taller t WHERE t.assigned_to = u.id AND t.deleted_at IS NULL AND t.status != 'pending' `+closedRange+`),
+			(SELECT ROUND(AVG(julianday(t.date_out) - julianday(t.date_in)), 1) FROM Taller t 
+				WHERE t.assigned_to = u.id AND t.deleted_at IS NULL AND t.status != 'pending' `+closedRange+`)
+		FROM Usuario u ORDER BY u.full_name ASC`, args...)
+	if err != nil { handleDbError(w, err); return }
+	defer rows.Close()
+
+	items := []TechnicianStats{}
+	for rows.Next() {
+		var s TechnicianStats
+		if err := rows.Scan(&s.ID, &s.Username, &s.FullName, &s.Open, &s.Repaired, &s.Unrepaired, &s.Closed, &s.AvgRepairDays); err != nil { continue }
+		items = append(items, s)
+	}
+	respondJSON(w, map[string]interface{}{"data": items})
+}
+
 func handleUsersCRUD(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		rows, err := db.Query("SELECT id, username, full_name, COALESCE(position, ''), rol FROM Usuario")
+		rows, err := db.Query(`SELECT id, username, full_name, COALESCE(position, ''), rol, must_change_password,
+			EXISTS (SELECT 1 FROM Intento_Acceso i WHERE i.kind = 'user' AND i.subject = username AND i.locked_until > ?)
+			FROM Usuario`, time.Now().Unix())
 		if err != nil {
 			respondError(w, 500, "Error DB: "+err.Error())
 			return
@@ -898,13 +1753,41 @@ func handleUsersCRUD(w http.ResponseWriter, r *http.Request) {
 		users := []User{}
 		for rows.Next() {
 			var u User
-			if err := rows.Scan(&u.ID, &u.Username, &u.FullName, &u.Position, &u.Role); err != nil {
+			if err := rows.Scan(&u.ID, &u.Username, &u.FullName, &u.Position, &u.Role, &u.MustChangePassword, &u.Locked); err != nil {
 				continue
 			}
 			users = append(users, u)
 		}
 		respondJSON(w, map[string]interface{}{"data": users})
 
+	} else if r.Method == "POST" {
+		var u User
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			respondError(w, 400, "JSON inválido")
+			return
+		}
+		u.Username = strings.TrimSpace(u.Username)
+		u.FullName = strings.TrimSpace(u.FullName)
+		if u.Username == "" || u.FullName == "" || u.Password == "" {
+			respondError(w, 400, "Usuario, nombre completo y contraseña son obligatorios")
+			return
+		}
+		if u.Role != ROLE_ADMIN && u.Role != ROLE_VIEWER {
+			respondError(w, 400, "Rol inválido")
+			return
+		}
+		if err := validatePasswordPolicy(u.Password); err != nil { respondError(w, 400, err.Error()); return }
+
+		// La contraseña inicial la define el administrador: el usuario debe cambiarla al ingresar
+		hash, err := hashPassword(u.Password)
+		if err != nil { respondError(w, 500, "Error procesando la contraseña"); return }
+		res, err := db.Exec("INSERT INTO Usuario (username, password, full_name, position, rol, must_change_password) VALUES (?, ?, ?, ?, ?, 1)",
+			u.Username, hash, u.FullName, u.Position, u.Role)
+		if err != nil { handleDbError(w, err); return }
+		newID, _ := res.LastInsertId()
+		recordAudit(r, "Usuario", newID, "create", nil, snapshotRow("Usuario", newID))
+		respondJSON(w, map[string]interface{}{"success": true, "id": newID})
+
 	} else if r.Method == "PUT" {
 		var u User
 		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
@@ -916,20 +1799,94 @@ func handleUsersCRUD(w http.ResponseWriter, r *http.Request) {
 			respondError(w, 400, "ID requerido")
 			return
 		}
+		if u.Role != ROLE_ADMIN && u.Role != ROLE_VIEWER {
+			respondError(w, 400, "Rol inválido")
+			return
+		}
+		if u.Role != ROLE_ADMIN && isLastAdmin(id) {
+			respondError(w, 409, "No se puede quitar el rol de administrador al último administrador.")
+			return
+		}
 
+		before := snapshotRow("Usuario", id)
 		if u.Password != "" {
-			_, err := db.Exec("UPDATE Usuario SET full_name=?, username=?, position=?, rol=?, password=? WHERE id=?", 
-				u.FullName, u.Username, u.Position, u.Role, u.Password, id)
+			if err := validatePasswordPolicy(u.Password); err != nil { respondError(w, 400, err.Error()); return }
+			hash, err := hashPassword(u.Password)
+			if err != nil { respondError(w, 500, "Error procesando la contraseña"); return }
+			// Un restablecimiento hecho por el administrador obliga al usuario a cambiarla
+			mustChange := 1
+			su := currentUser(r)
+			self := su != nil && strconv.Itoa(su.ID) == id
+			if self { mustChange = 0 }
+			tx, err := db.Begin()
+			if err != nil { handleDbError(w, err); return }
+			defer tx.Rollback()
+			_, err = tx.Exec("UPDATE Usuario SET full_name=?, username=?, position=?, rol=?, password=?, must_change_password=? WHERE id=?", 
+				u.FullName, u.Username, u.Position, u.Role, hash, mustChange, id)
+			if err != nil { handleDbError(w, err); return }
+			// Las sesiones abiertas con la contraseña anterior dejan de ser válidas (salvo la actual si se la cambia uno mismo)
+			if self {
+				_, err = tx.Exec("DELETE FROM Sesion WHERE id_user = ? AND token != ?", id, su.Token)
+			} else {
+				_, err = tx.Exec("DELETE FROM Sesion WHERE id_user = ?", id)
+			}
 			if err != nil { handleDbError(w, err); return }
+			if err := tx.Commit(); err != nil { handleDbError(w, err); return }
 		} else {
 			_, err := db.Exec("UPDATE Usuario SET full_name=?, username=?, position=?, rol=? WHERE id=?", 
 				u.FullName, u.Username, u.Position, u.Role, id)
 			if err != nil { handleDbError(w, err); return }
 		}
+		recordAudit(r, "Usuario", id, "update", before, snapshotRow("Usuario", id))
+		respondJSON(w, map[string]bool{"success": true})
+
+	} else if r.Method == "DELETE" {
+		id := r.URL.Query().Get("id")
+		if id == "" { respondError(w, 400, "ID requerido"); return }
+		if su := currentUser(r); su != nil && strconv.Itoa(su.ID) == id {
+			respondError(w, 409, "No puede eliminar su propia cuenta.")
+			return
+		}
+		if isLastAdmin(id) {
+			respondError(w, 409, "No se puede eliminar al último administrador.")
+			return
+		}
+
+		if uid, err := strconv.Atoi(id); err != nil || !userExists(uid) { respondError(w, 404, "Usuario no encontrado"); return }
+
+		before := snapshotRow("Usuario", id)
+		tx, err := db.Begin()
+		if err != nil { handleDbError(w, err); return }
+		defer tx.Rollback()
+		for _, q := range []string{
+			"DELETE FROM Sesion WHERE id_user = ?",
+			"UPDATE Taller SET received_by = NULL WHERE received_by = ?",
+			"UPDATE Taller SET assigned_to = NULL WHERE assigned_to = ?",
+			"DELETE FROM Usuario WHERE id = ?",
+		} {
+			if _, err := tx.Exec(q, id); err != nil { handleDbError(w, err); return }
+		}
+		if err := tx.Commit(); err != nil { handleDbError(w, err); return }
+		recordAudit(r, "Usuario", id, "delete", before, nil)
 		respondJSON(w, map[string]bool{"success": true})
 	}
 }
 
+// userExists : Valida referencias a Usuario (técnicos de un ticket)
+func userExists(id int) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM Usuario WHERE id = ?", id).Scan(&count)
+	return count > 0
+}
+
+// isLastAdmin : Indica si el usuario es administrador y no queda ningún otro
+func isLastAdmin(id string) bool {
+	var isAdmin, others int
+	db.QueryRow("SELECT COUNT(*) FROM Usuario WHERE id = ? AND rol = 'admin'", id).Scan(&isAdmin)
+	db.QueryRow("SELECT COUNT(*) FROM Usuario WHERE id != ? AND rol = 'admin'", id).Scan(&others)
+	return isAdmin > 0 && others == 0
+}
+
 // --- HANDLERS SELECTORES ---
 
 func handleSpecs(w http.ResponseWriter, r *http.Request) {
@@ -941,6 +1898,7 @@ func handleSpecs(w http.ResponseWriter, r *http.Request) {
 		RAMs:          getSelectItems("RAM", "ram"),
 		Storages:      getSelectItems("Almacenamiento", "storage"),
 		Processors:    getSelectItems("Procesador", "processor"),
+		Parts:         getSelectItems("Repuesto", "part"),
 		Architectures: []SelectItem{{ID: 1, Value: "32 bits"}, {ID: 2, Value: "64 bits"}},
 	}
 	respondJSON(w, map[string]interface{}{"success": true, "data": resp})
@@ -970,7 +1928,7 @@ func makeSimpleMasterHandler(table, field, fkCheck string) http.HandlerFunc {
 			offset := (page - 1) * limit
 			
 			search := r.URL.Query().Get("search")
-			where := " WHERE 1=1 "
+			where := " WHERE deleted_at IS NULL "
 			args := []interface{}{}
 
 			if search != "" {
@@ -1001,8 +1959,10 @@ func makeSimpleMasterHandler(table, field, fkCheck string) http.HandlerFunc {
 			val := strings.TrimSpace(d.Value)
 			if val == "" { respondError(w, 400, "Valor vacío"); return }
 			
-			_, err := db.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (?)", table, field), val)
+			res, err := db.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (?)", table, field), val)
 			if err != nil { handleDbError(w, err); return }
+			newID, _ := res.LastInsertId()
+			recordAudit(r, table, newID, "create", nil, snapshotRow(table, newID))
 			respondJSON(w, map[string]bool{"success": true})
 
 		} else if r.Method == "PUT" {
@@ -1012,8 +1972,10 @@ func makeSimpleMasterHandler(table, field, fkCheck string) http.HandlerFunc {
 			val := strings.TrimSpace(d.Value)
 			if id == "" || val == "" { respondError(w, 400, "Datos inválidos"); return }
 
+			before := snapshotRow(table, id)
 			_, err := db.Exec(fmt.Sprintf("UPDATE %s SET %s=? WHERE id=?", table, field), val, id)
 			if err != nil { handleDbError(w, err); return }
+			recordAudit(r, table, id, "update", before, snapshotRow(table, id))
 			respondJSON(w, map[string]bool{"success": true})
 
 		} else if r.Method == "DELETE" {
@@ -1023,7 +1985,7 @@ func makeSimpleMasterHandler(table, field, fkCheck string) http.HandlerFunc {
 			// Validación de Integridad Referencial
 			if fkCheck != "" {
 				var count int
-				db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM Dispositivo WHERE %s = ?", fkCheck), id).Scan(&count)
+				db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM Dispositivo WHERE %s = ? AND deleted_at IS NULL", fkCheck), id).Scan(&count)
 				if count > 0 {
 					respondError(w, 409, "No se puede eliminar: El dato está asociado a dispositivos.")
 					return
@@ -1032,15 +1994,17 @@ func makeSimpleMasterHandler(table, field, fkCheck string) http.HandlerFunc {
 			
 			if table == "Marca" {
 				var count int
-				db.QueryRow("SELECT COUNT(*) FROM Modelo WHERE id_brand = ?", id).Scan(&count)
+				db.QueryRow("SELECT COUNT(*) FROM Modelo WHERE id_brand = ? AND deleted_at IS NULL", id).Scan(&count)
 				if count > 0 {
 					respondError(w, 409, "No se puede eliminar: La marca tiene modelos asociados.")
 					return
 				}
 			}
 
-			_, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id=?", table), id)
+			before := snapshotRow(table, id)
+			err := softDelete(table, id)
 			if err != nil { handleDbError(w, err); return }
+			recordAudit(r, table, id, "delete", before, nil)
 			respondJSON(w, map[string]bool{"success": true})
 		}
 	}
@@ -1056,7 +2020,7 @@ func handleModelMasterCRUD(w http.ResponseWriter, r *http.Request) {
 		offset := (page - 1) * limit
 
 		search := r.URL.Query().Get("search")
-		where := " WHERE 1=1 "
+		where := " WHERE m.deleted_at IS NULL "
 		args := []interface{}{}
 
 		if search != "" {
@@ -1088,8 +2052,10 @@ func handleModelMasterCRUD(w http.ResponseWriter, r *http.Request) {
 		var brandID int
 		if pid, ok := d.ParentID.(float64); ok { brandID = int(pid) } else { respondError(w, 400, "Marca (parent_id) inválida"); return }
 		
-		_, err := db.Exec("INSERT INTO Modelo (model, id_brand) VALUES (?, ?)", d.Value, brandID)
+		res, err := db.Exec("INSERT INTO Modelo (model, id_brand) VALUES (?, ?)", d.Value, brandID)
 		if err != nil { handleDbError(w, err); return }
+		newID, _ := res.LastInsertId()
+		recordAudit(r, "Modelo", newID, "create", nil, snapshotRow("Modelo", newID))
 		respondJSON(w, map[string]bool{"success": true})
 
 	} else if r.Method == "PUT" {
@@ -1099,18 +2065,22 @@ func handleModelMasterCRUD(w http.ResponseWriter, r *http.Request) {
 		var brandID int
 		if pid, ok := d.ParentID.(float64); ok { brandID = int(pid) } else { respondError(w, 400, "Marca (parent_id) inválida"); return }
 
+		before := snapshotRow("Modelo", id)
 		_, err := db.Exec("UPDATE Modelo SET model=?, id_brand=? WHERE id=?", d.Value, brandID, id)
 		if err != nil { handleDbError(w, err); return }
+		recordAudit(r, "Modelo", id, "update", before, snapshotRow("Modelo", id))
 		respondJSON(w, map[string]bool{"success": true})
 
 	} else if r.Method == "DELETE" {
 		id := r.URL.Query().Get("id")
 		if id == "" { respondError(w, 400, "ID requerido"); return }
 		var count int
-		db.QueryRow("SELECT COUNT(*) FROM Dispositivo WHERE id_model = ?", id).Scan(&count)
+		db.QueryRow("SELECT COUNT(*) FROM Dispositivo WHERE id_model = ? AND deleted_at IS NULL", id).Scan(&count)
 		if count > 0 { respondError(w, 409, "Modelo en uso por dispositivos."); return }
-		_, err := db.Exec("DELETE FROM Modelo WHERE id=?", id)
+		before := snapshotRow("Modelo", id)
+		err := softDelete("Modelo", id)
 		if err != nil { handleDbError(w, err); return }
+		recordAudit(r, "Modelo", id, "delete", before, nil)
 		respondJSON(w, map[string]bool{"success": true})
 	}
 }
@@ -1123,10 +2093,12 @@ func handleBuildingMasterCRUD(w http.ResponseWriter, r *http.Request) {
 		id := r.URL.Query().Get("id")
 		if id == "" { respondError(w, 400, "ID requerido"); return }
 		var count int
-		db.QueryRow("SELECT COUNT(*) FROM Piso WHERE id_building = ?", id).Scan(&count)
+		db.QueryRow("SELECT COUNT(*) FROM Piso WHERE id_building = ? AND deleted_at IS NULL", id).Scan(&count)
 		if count > 0 { respondError(w, 409, "No se puede eliminar: El edificio tiene pisos registrados."); return }
-		_, err := db.Exec("DELETE FROM Edificio WHERE id=?", id)
+		before := snapshotRow("Edificio", id)
+		err := softDelete("Edificio", id)
 		if err != nil { handleDbError(w, err); return }
+		recordAudit(r, "Edificio", id, "delete", before, nil)
 		respondJSON(w, map[string]bool{"success": true})
 	} else {
 		makeSimpleMasterHandler("Edificio", "building", "")(w, r)
@@ -1143,7 +2115,7 @@ func handleFloorMasterCRUD(w http.ResponseWriter, r *http.Request) {
 		offset := (page - 1) * limit
 		search := r.URL.Query().Get("search")
 		
-		where := " WHERE 1=1 "
+		where := " WHERE p.deleted_at IS NULL "
 		args := []interface{}{}
 		if search != "" { where += " AND (e.building || ' > ' || p.floor) LIKE ? "; args = append(args, "%"+search+"%") }
 
@@ -1162,25 +2134,31 @@ func handleFloorMasterCRUD(w http.ResponseWriter, r *http.Request) {
 	} else if r.Method == "POST" {
 		var d MasterItem; json.NewDecoder(r.Body).Decode(&d)
 		var pid int; if p, ok := d.ParentID.(float64); ok { pid = int(p) } else { respondError(w, 400, "Edificio requerido"); return }
-		_, err := db.Exec("INSERT INTO Piso (floor, id_building) VALUES (?, ?)", d.Value, pid)
+		res, err := db.Exec("INSERT INTO Piso (floor, id_building) VALUES (?, ?)", d.Value, pid)
 		if err != nil { handleDbError(w, err); return }
+		newID, _ := res.LastInsertId()
+		recordAudit(r, "Piso", newID, "create", nil, snapshotRow("Piso", newID))
 		respondJSON(w, map[string]bool{"success": true})
 
 	} else if r.Method == "PUT" {
 		var d MasterItem; json.NewDecoder(r.Body).Decode(&d)
 		id := r.URL.Query().Get("id")
 		var pid int; if p, ok := d.ParentID.(float64); ok { pid = int(p) } else { respondError(w, 400, "Edificio requerido"); return }
+		before := snapshotRow("Piso", id)
 		_, err := db.Exec("UPDATE Piso SET floor=?, id_building=? WHERE id=?", d.Value, pid, id)
 		if err != nil { handleDbError(w, err); return }
+		recordAudit(r, "Piso", id, "update", before, snapshotRow("Piso", id))
 		respondJSON(w, map[string]bool{"success": true})
 
 	} else if r.Method == "DELETE" {
 		id := r.URL.Query().Get("id")
 		var count int
-		db.QueryRow("SELECT COUNT(*) FROM Area WHERE id_floor = ?", id).Scan(&count)
+		db.QueryRow("SELECT COUNT(*) FROM Area WHERE id_floor = ? AND deleted_at IS NULL", id).Scan(&count)
 		if count > 0 { respondError(w, 409, "Piso tiene áreas asociadas."); return }
-		_, err := db.Exec("DELETE FROM Piso WHERE id=?", id)
+		before := snapshotRow("Piso", id)
+		err := softDelete("Piso", id)
 		if err != nil { handleDbError(w, err); return }
+		recordAudit(r, "Piso", id, "delete", before, nil)
 		respondJSON(w, map[string]bool{"success": true})
 	}
 }
@@ -1195,7 +2173,7 @@ func handleAreaMasterCRUD(w http.ResponseWriter, r *http.Request) {
 		offset := (page - 1) * limit
 		search := r.URL.Query().Get("search")
 		
-		where := " WHERE 1=1 "
+		where := " WHERE a.deleted_at IS NULL "
 		args := []interface{}{}
 		if search != "" { where += " AND (e.building || ' > ' || p.floor || ' > ' || a.area) LIKE ? "; args = append(args, "%"+search+"%") }
 
@@ -1214,30 +2192,36 @@ func handleAreaMasterCRUD(w http.ResponseWriter, r *http.Request) {
 	} else if r.Method == "POST" {
 		var d MasterItem; json.NewDecoder(r.Body).Decode(&d)
 		var pid int; if p, ok := d.ParentID.(float64); ok { pid = int(p) } else { respondError(w, 400, "Piso requerido"); return }
-		_, err := db.Exec("INSERT INTO Area (area, id_floor) VALUES (?, ?)", d.Value, pid)
+		res, err := db.Exec("INSERT INTO Area (area, id_floor) VALUES (?, ?)", d.Value, pid)
 		if err != nil { handleDbError(w, err); return }
+		newID, _ := res.LastInsertId()
+		recordAudit(r, "Area", newID, "create", nil, snapshotRow("Area", newID))
 		respondJSON(w, map[string]bool{"success": true})
 
 	} else if r.Method == "PUT" {
 		var d MasterItem; json.NewDecoder(r.Body).Decode(&d)
 		id := r.URL.Query().Get("id")
 		var pid int; if p, ok := d.ParentID.(float64); ok { pid = int(p) } else { respondError(w, 400, "Piso requerido"); return }
+		before := snapshotRow("Area", id)
 		_, err := db.Exec("UPDATE Area SET area=?, id_floor=? WHERE id=?", d.Value, pid, id)
 		if err != nil { handleDbError(w, err); return }
+		recordAudit(r, "Area", id, "update", before, snapshotRow("Area", id))
 		respondJSON(w, map[string]bool{"success": true})
 
 	} else if r.Method == "DELETE" {
 		id := r.URL.Query().Get("id")
 		var count int
 		// Check Departamentoes
-		db.QueryRow("SELECT COUNT(*) FROM Departamento WHERE id_area = ?", id).Scan(&count)
+		db.QueryRow("SELECT COUNT(*) FROM Departamento WHERE id_area = ? AND deleted_at IS NULL", id).Scan(&count)
 		if count > 0 { respondError(w, 409, "Área tiene habitaciones asociadas."); return }
 		// Check Ubicacion (link table)
-		db.QueryRow("SELECT COUNT(*) FROM Ubicacion WHERE id_area = ?", id).Scan(&count)
+		db.QueryRow("SELECT COUNT(*) FROM Ubicacion WHERE id_area = ? AND deleted_at IS NULL", id).Scan(&count)
 		if count > 0 { respondError(w, 409, "Área está en uso en ubicaciones."); return }
 		
-		_, err := db.Exec("DELETE FROM Area WHERE id=?", id)
+		before := snapshotRow("Area", id)
+		err := softDelete("Area", id)
 		if err != nil { handleDbError(w, err); return }
+		recordAudit(r, "Area", id, "delete", before, nil)
 		respondJSON(w, map[string]bool{"success": true})
 	}
 }
@@ -1252,7 +2236,7 @@ func handleRoomMasterCRUD(w http.ResponseWriter, r *http.Request) {
 		offset := (page - 1) * limit
 		search := r.URL.Query().Get("search")
 		
-		where := " WHERE 1=1 "
+		where := " WHERE h.deleted_at IS NULL "
 		args := []interface{}{}
 		if search != "" { where += " AND (e.building || ' > ' || p.floor || ' > ' || a.area || ' > ' || h.room) LIKE ? "; args = append(args, "%"+search+"%") }
 
@@ -1272,25 +2256,31 @@ func handleRoomMasterCRUD(w http.ResponseWriter, r *http.Request) {
 	} else if r.Method == "POST" {
 		var d MasterItem; json.NewDecoder(r.Body).Decode(&d)
 		var pid int; if p, ok := d.ParentID.(float64); ok { pid = int(p) } else { respondError(w, 400, "Área requerida"); return }
-		_, err := db.Exec("INSERT INTO Departamento (room, id_area) VALUES (?, ?)", d.Value, pid)
+		res, err := db.Exec("INSERT INTO Departamento (room, id_area) VALUES (?, ?)", d.Value, pid)
 		if err != nil { handleDbError(w, err); return }
+		newID, _ := res.LastInsertId()
+		recordAudit(r, "Departamento", newID, "create", nil, snapshotRow("Departamento", newID))
 		respondJSON(w, map[string]bool{"success": true})
 
 	} else if r.Method == "PUT" {
 		var d MasterItem; json.NewDecoder(r.Body).Decode(&d)
 		id := r.URL.Query().Get("id")
 		var pid int; if p, ok := d.ParentID.(float64); ok { pid = int(p) } else { respondError(w, 400, "Área requerida"); return }
+		before := snapshotRow("Departamento", id)
 		_, err := db.Exec("UPDATE Departamento SET room=?, id_area=? WHERE id=?", d.Value, pid, id)
 		if err != nil { handleDbError(w, err); return }
+		recordAudit(r, "Departamento", id, "update", before, snapshotRow("Departamento", id))
 		respondJSON(w, map[string]bool{"success": true})
 
 	} else if r.Method == "DELETE" {
 		id := r.URL.Query().Get("id")
 		var count int
-		db.QueryRow("SELECT COUNT(*) FROM Ubicacion WHERE id_room = ?", id).Scan(&count)
+		db.QueryRow("SELECT COUNT(*) FROM Ubicacion WHERE id_room = ? AND deleted_at IS NULL", id).Scan(&count)
 		if count > 0 { respondError(w, 409, "Departamento en uso."); return }
-		_, err := db.Exec("DELETE FROM Departamento WHERE id=?", id)
+		before := snapshotRow("Departamento", id)
+		err := softDelete("Departamento", id)
 		if err != nil { handleDbError(w, err); return }
+		recordAudit(r, "Departamento", id, "delete", before, nil)
 		respondJSON(w, map[string]bool{"success": true})
 	}
 }
@@ -1343,8 +2333,10 @@ func handleLocationMasterCRUD(w http.ResponseWriter, r *http.Request) {
 		if err := json.NewDecoder(r.Body).Decode(&d); err != nil { respondError(w, 400, "JSON inválido"); return }
 		id := r.URL.Query().Get("id")
 		
+		before := snapshotRow("Ubicacion", id)
 		_, err := db.Exec("UPDATE Ubicacion SET details=? WHERE id=?", d.Details, id)
 		if err != nil { handleDbError(w, err); return }
+		recordAudit(r, "Ubicacion", id, "update", before, snapshotRow("Ubicacion", id))
 		respondJSON(w, map[string]bool{"success": true})
 
 	} else if r.Method == "DELETE" {
@@ -1352,11 +2344,13 @@ func handleLocationMasterCRUD(w http.ResponseWriter, r *http.Request) {
 		if id == "" { respondError(w, 400, "ID requerido"); return }
 
 		var count int
-		db.QueryRow("SELECT COUNT(*) FROM Dispositivo WHERE id_location = ?", id).Scan(&count)
+		db.QueryRow("SELECT COUNT(*) FROM Dispositivo WHERE id_location = ? AND deleted_at IS NULL", id).Scan(&count)
 		if count > 0 { respondError(w, 409, "Ubicación contiene dispositivos."); return }
 
-		_, err := db.Exec("DELETE FROM Ubicacion WHERE id=?", id)
+		before := snapshotRow("Ubicacion", id)
+		err := softDelete("Ubicacion", id)
 		if err != nil { handleDbError(w, err); return }
+		recordAudit(r, "Ubicacion", id, "delete", before, nil)
 		respondJSON(w, map[string]bool{"success": true})
 	}
 }
@@ -1371,48 +2365,12 @@ func handleDevicesCRUD(w http.ResponseWriter, r *http.Request) {
 		if limit < 1 { limit = 4 }
 		offset := (page - 1) * limit
 
-		where := " WHERE 1=1 "
-		args := []interface{}{}
-
-		search := r.URL.Query().Get("search")
-		if search != "" {
-			term := "%" + search + "%"
-			where += ` AND (
-				v.code LIKE ? OR v.serial LIKE ? OR v.brand LIKE ? OR v.model LIKE ? OR 
-				v.building LIKE ? OR v.area LIKE ? OR v.os LIKE ? OR v.details LIKE ?
-			) `
-			for i := 0; i < 8; i++ { args = append(args, term) }
-		}
-		
-		if val := r.URL.Query().Get("type"); val != "" { where += " AND v.id_type = ? "; args = append(args, val) }
-		if val := r.URL.Query().Get("brand"); val != "" { where += " AND v.id_brand = ? "; args = append(args, val) }
-		if val := r.URL.Query().Get("os"); val != "" { where += " AND v.id_os = ? "; args = append(args, val) }
-		if val := r.URL.Query().Get("id_building"); val != "" { where += " AND v.id_building = ? "; args = append(args, val) }
-		if val := r.URL.Query().Get("id_floor"); val != "" { where += " AND v.id_floor = ? "; args = append(args, val) }
-		if val := r.URL.Query().Get("id_area"); val != "" { where += " AND v.id_area = ? "; args = append(args, val) }
-		if val := r.URL.Query().Get("id_room"); val != "" { where += " AND v.id_room = ? "; args = append(args, val) }
-
-		statusSubQuery := "(SELECT 1 FROM Taller t WHERE t.id_device = v.device_id AND t.status = 'pending')"
-		statusFilter := r.URL.Query().Get("status")
-		if statusFilter == "workshop" {
-			where += fmt.Sprintf(" AND EXISTS %s ", statusSubQuery)
-		} else if statusFilter == "operational" {
-			where += fmt.Sprintf(" AND NOT EXISTS %s ", statusSubQuery)
-		}
+		where, args := deviceListFilter(r)
 
 		var total int
 		db.QueryRow("SELECT COUNT(*) FROM Vista_Datos_Dispositivo_Completo v "+where, args...).Scan(&total)
 
-		query := `
-			SELECT 
-				v.device_id, v.code, v.device_type, v.brand, v.model, v.serial,
-				v.building, v.floor, v.area, v.room,
-				v.id_building, v.id_floor, v.id_area, v.id_room,
-				v.os, v.ram, v.storage, v.processor, v.arch, v.details,
-				CASE WHEN EXISTS ` + statusSubQuery + ` THEN 'workshop' ELSE 'operational' END,
-				CASE WHEN EXISTS ` + statusSubQuery + ` THEN 'En Taller' ELSE 'Operativo' END
-			FROM Vista_Datos_Dispositivo_Completo v
-			` + where + ` ORDER BY v.device_id DESC LIMIT ? OFFSET ?`
+		query := deviceSelectSQL + where + ` ORDER BY v.device_id DESC LIMIT ? OFFSET ?`
 		
 		args = append(args, limit, offset)
 		rows, err := db.Query(query, args...)
@@ -1425,14 +2383,7 @@ func handleDevicesCRUD(w http.ResponseWriter, r *http.Request) {
 
 		items := []Device{}
 		for rows.Next() {
-			var d Device
-			err := rows.Scan(
-				&d.ID, &d.Code, &d.Type, &d.Brand, &d.Model, &d.Serial,
-				&d.Building, &d.Floor, &d.Area, &d.Room,
-				&d.IDBuilding, &d.IDFloor, &d.IDArea, &d.IDRoom,
-				&d.OS, &d.RAM, &d.Storage, &d.CPU, &d.Arch, &d.Details,
-				&d.Status, &d.StatusLabel)
-			
+			d, err := scanDevice(rows)
 			if err != nil { continue }
 			items = append(items, d)
 		}
@@ -1482,24 +2433,33 @@ func handleDevicesCRUD(w http.ResponseWriter, r *http.Request) {
 			argsLoc = []interface{}{d.IDArea}
 		}
 		
-		err := db.QueryRow(queryLoc, argsLoc...).Scan(&idLocation)
-		if err == sql.ErrNoRows {
+		var locDeleted sql.NullString
+		err := db.QueryRow(strings.Replace(queryLoc, "SELECT id", "SELECT id, deleted_at", 1)+" ORDER BY deleted_at IS NOT NULL, id LIMIT 1", argsLoc...).Scan(&idLocation, &locDeleted)
+		if err == nil && locDeleted.Valid {
+			// La combinación existía en la papelera: se reactiva al volver a usarla
+			db.Exec("UPDATE Ubicacion SET deleted_at = NULL WHERE id = ?", idLocation)
+			recordAudit(r, "Ubicacion", idLocation, "restore", nil, snapshotRow("Ubicacion", idLocation))
+		} else if err == sql.ErrNoRows {
 			res, errIns := db.Exec("INSERT INTO Ubicacion (id_area, id_room) VALUES (?, ?)", d.IDArea, d.IDRoom)
 			if errIns != nil { handleDbError(w, errIns); return }
 			id, _ := res.LastInsertId()
 			idLocation = int(id)
+			recordAudit(r, "Ubicacion", id, "create", nil, snapshotRow("Ubicacion", id))
 		} else if err != nil {
 			respondError(w, 500, "Error ubicacion: "+err.Error()); return
 		}
 
 		if r.Method == "POST" {
-			_, err = db.Exec(`INSERT INTO Dispositivo 
+			res, err := db.Exec(`INSERT INTO Dispositivo 
 				(code, id_type, id_location, id_brand, id_model, serial, id_os, id_ram, id_storage, id_processor, arch, details)
 				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 				d.Code, d.IDType, idLocation, d.IDBrand, d.IDModel, d.Serial, d.IDOS, d.IDRAM, d.IDStorage, d.IDProcessor, d.Arch, d.Details)
 			if err != nil { handleDbError(w, err); return }
+			newID, _ := res.LastInsertId()
+			recordAudit(r, "Dispositivo", newID, "create", nil, snapshotRow("Dispositivo", newID))
 		} else {
 			id := r.URL.Query().Get("id")
+			before := snapshotRow("Dispositivo", id)
 			_, err = db.Exec(`UPDATE Dispositivo SET 
 				code=?, id_type=?, id_location=?, id_brand=?, id_model=?, serial=?, 
 				id_os=?, id_ram=?, id_storage=?, id_processor=?, arch=?, details=?
@@ -1507,23 +2467,2008 @@ func handleDevicesCRUD(w http.ResponseWriter, r *http.Request) {
 				d.Code, d.IDType, idLocation, d.IDBrand, d.IDModel, d.Serial, 
 				d.IDOS, d.IDRAM, d.IDStorage, d.IDProcessor, d.Arch, d.Details, id)
 			if err != nil { handleDbError(w, err); return }
+			after := snapshotRow("Dispositivo", id)
+			recordAudit(r, "Dispositivo", id, "update", before, after)
+			recordDeviceChanges(r, id, before, after)
 		}
 		respondJSON(w, map[string]bool{"success": true})
 	} else if r.Method == "DELETE" {
 		id := r.URL.Query().Get("id")
 		if id == "" { respondError(w, 400, "ID requerido"); return }
 		var count int
-		db.QueryRow("SELECT COUNT(*) FROM Taller WHERE id_device = ?", id).Scan(&count)
+		db.QueryRow("SELECT COUNT(*) FROM Taller WHERE id_device = ? AND deleted_at IS NULL", id).Scan(&count)
 		if count > 0 { respondError(w, 409, "El equipo tiene historial."); return }
-		_, err := db.Exec("DELETE FROM Dispositivo WHERE id = ?", id)
+		before := snapshotRow("Dispositivo", id)
+		err := softDelete("Dispositivo", id)
 		if err != nil { handleDbError(w, err); return }
+		recordAudit(r, "Dispositivo", id, "delete", before, nil)
 		respondJSON(w, map[string]bool{"success": true})
 	}
 }
 
-// --- HANDLERS TICKETS ---
-
-func handleTicketsCRUD(w http.ResponseWriter, r *http.Request) {
+// deviceListFilter : WHERE y argumentos de los filtros del inventario (listado y exportación)
+func deviceListFilter(r *http.Request) (string, []interface{}) {
+	where := " WHERE 1=1 "
+	args := []interface{}{}
+
+	search := r.URL.Query().Get("search")
+	if search != "" {
+		term := "%" + search + "%"
+		where += ` AND (
+			v.code LIKE ? OR v.serial LIKE ? OR v.brand LIKE ? OR v.model LIKE ? OR 
+			v.building LIKE ? OR v.area LIKE ? OR v.os LIKE ? OR v.details LIKE ?
+		) `
+		for i := 0; i < 8; i++ { args = append(args, term) }
+	}
+	
+	if val := r.URL.Query().Get("type"); val != "" { where += " AND v.id_type = ? "; args = append(args, val) }
+	if val := r.URL.Query().Get("brand"); val != "" { where += " AND v.id_brand = ? "; args = append(args, val) }
+	if val := r.URL.Query().Get("os"); val != "" { where += " AND v.id_os = ? "; args = append(args, val) }
+	if val := r.URL.Query().Get("id_building"); val != "" { where += " AND v.id_building = ? "; args = append(args, val) }
+	if val := r.URL.Query().Get("id_floor"); val != "" { where += " AND v.id_floor = ? "; args = append(args, val) }
+	if val := r.URL.Query().Get("id_area"); val != "" { where += " AND v.id_area = ? "; args = append(args, val) }
+	if val := r.URL.Query().Get("id_room"); val != "" { where += " AND v.id_room = ? "; args = append(args, val) }
+
+	statusSubQuery := deviceStatusSubQuery
+	statusFilter := r.URL.Query().Get("status")
+	if statusFilter == "workshop" {
+		where += fmt.Sprintf(" AND EXISTS %s ", statusSubQuery)
+	} else if statusFilter == "operational" {
+		where += fmt.Sprintf(" AND NOT EXISTS %s ", statusSubQuery)
+	}
+	return where, args
+}
+
+// deviceExportHeader : Encabezados de la exportación (la importación los reconoce, salvo ID y Estado)
+var deviceExportHeader = []string{"ID", "Código Bien Nacional", "Tipo", "Marca", "Modelo", "Serial", "Edificio", "Piso", "Área", "Departamento",
+	"Sistema Operativo", "RAM", "Almacenamiento", "Procesador", "Arquitectura", "Detalles", "Estado"}
+
+// handleDeviceExport : Inventario completo (sin paginar) con los mismos filtros del listado, ?format=csv|xlsx
+func handleDeviceExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" { format = "csv" }
+	if format != "csv" && format != "xlsx" { respondError(w, 400, "Formato inválido (csv o xlsx)"); return }
+
+	where, args := deviceListFilter(r)
+	rows, err := db.Query(deviceSelectSQL+where+" ORDER BY v.building, v.floor, v.area, v.room, v.device_type, v.code", args...)
+	if err != nil { handleDbError(w, err); return }
+	defer rows.Close()
+
+	str := func(s *string) string { if s == nil { return "" }; return *s }
+	record := func(d Device) []string {
+		return []string{strconv.Itoa(d.ID), str(d.Code), d.Type, str(d.Brand), str(d.Model), str(d.Serial),
+			d.Building, d.Floor, d.Area, str(d.Room), str(d.OS), str(d.RAM), str(d.Storage), str(d.CPU), str(d.Arch), str(d.Details), d.StatusLabel}
+	}
+	filename := "inventario_" + time.Now().Format("2006-01-02") + "." + format
+
+	// El XLSX es un ZIP: se arma completo en memoria, así un error todavía puede responderse como JSON
+	if format == "xlsx" {
+		data := [][]string{}
+		for rows.Next() {
+			d, err := scanDevice(rows)
+			if err != nil { handleDbError(w, err); return }
+			data = append(data, record(d))
+		}
+		if err := rows.Err(); err != nil { handleDbError(w, err); return }
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		if err := writeXLSX(w, "Inventario", deviceExportHeader, data); err != nil { log.Printf("Error exportando XLSX: %v", err) }
+		return
+	}
+
+	// El CSV se escribe fila por fila. BOM y ';' para que Excel en español abra el archivo con acentos y columnas correctas.
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	io.WriteString(w, "\ufeff")
+	cw := csv.NewWriter(w)
+	cw.Comma = ';'
+	cw.Write(deviceExportHeader)
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil { log.Printf("Error exportando CSV (archivo incompleto): %v", err); return }
+		cw.Write(record(d))
+	}
+	if err := rows.Err(); err != nil { log.Printf("Error exportando CSV (archivo incompleto): %v", err); return }
+	cw.Flush()
+	if err := cw.Error(); err != nil { log.Printf("Error exportando CSV: %v", err) }
+}
+
+// --- ETIQUETAS DE EQUIPOS ---
+
+// LabelSheet : Formato de hoja carta de etiquetas (medidas en pulgadas, como las publica el fabricante)
+type LabelSheet struct {
+	Code       string  `json:"code"`
+	Name       string  `json:"name"`
+	Columns    int     `json:"columns"`
+	Rows       int     `json:"rows"`
+	Width      float64 `json:"width"`
+	Height     float64 `json:"height"`
+	Left       float64 `json:"left"`
+	Top        float64 `json:"top"`
+	HorizPitch float64 `json:"horiz_pitch"`
+	VertPitch  float64 `json:"vert_pitch"`
+}
+
+// labelSheets : Formatos compatibles con las hojas Avery (carta) más comunes; el primero es el predeterminado
+var labelSheets = []LabelSheet{
+	{"5160", "Avery 5160 - 30 etiquetas de 2⅝\" x 1\"", 3, 10, 2.625, 1, 0.1875, 0.5, 2.75, 1},
+	{"5161", "Avery 5161 - 20 etiquetas de 4\" x 1\"", 2, 10, 4, 1, 0.15625, 0.5, 4.1875, 1},
+	{"5163", "Avery 5163 - 10 etiquetas de 4\" x 2\"", 2, 5, 4, 2, 0.15625, 0.5, 4.1875, 2},
+	{"5167", "Avery 5167 - 80 etiquetas de 1¾\" x ½\"", 4, 20, 1.75, 0.5, 0.28125, 0.5, 2.0625, 0.5},
+	{"5262", "Avery 5262 - 14 etiquetas de 4\" x 1⅓\"", 2, 7, 4, 1.33, 0.15625, 0.83, 4.1875, 1.33},
+}
+
+// drawDeviceLabel : Tipo, código de barras, valor codificado y ubicación. En etiquetas bajas solo el código.
+func drawDeviceLabel(c labelCanvas, d Device, value string, x, y, w, h float64) {
+	pad := 5.0
+	x, y, w, h = x+pad, y+pad, w-2*pad, h-2*pad
+	if h < 40 {
+		drawCode128(c, value, x, y, w, h-9)
+		c.Text(x, y+h-1, w, 6.5, false, "C", fitText(value, 6.5, false, w))
+		return
+	}
+	c.Text(x, y+7, w, 7, true, "L", fitText(strings.ToUpper(d.Type), 7, true, w))
+	location := d.Area
+	if d.Room != nil { location += " > " + *d.Room }
+	c.Text(x, y+h-1, w, 6, false, "L", fitText(location, 6, false, w))
+	// El código (máx. 50 pt de alto) y su texto se centran entre el tipo y la ubicación
+	avail := h - 29
+	bh := avail
+	if bh > 50 { bh = 50 }
+	by := y + 10 + (avail-bh)/2
+	drawCode128(c, value, x, by, w, bh)
+	c.Text(x, by+bh+9, w, 7, false, "C", fitText(value, 7, false, w))
+}
+
+// handleDeviceLabels : Hoja de etiquetas con código de barras Code 128 para un equipo (?id=, admite lista 1,2,3)
+// o para los filtros del inventario. ?format=pdf|svg, ?size= (ver ?sizes=1), ?encode=code|id, ?skip= etiquetas
+// ya usadas en la primera hoja. Sin código Bien Nacional se codifica el ID del equipo.
+func handleDeviceLabels(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("sizes") != "" { respondJSON(w, map[string]interface{}{"data": labelSheets}); return }
+
+	format := q.Get("format")
+	if format == "" { format = "pdf" }
+	if format != "pdf" && format != "svg" { respondError(w, 400, "Formato inválido (pdf o svg)"); return }
+	sheet := labelSheets[0]
+	if size := q.Get("size"); size != "" {
+		found := false
+		for _, s := range labelSheets {
+			if s.Code == size { sheet, found = s, true }
+		}
+		if !found { respondError(w, 400, "Tamaño de etiqueta desconocido: "+size); return }
+	}
+	encode := q.Get("encode")
+	if encode == "" { encode = "code" }
+	if encode != "code" && encode != "id" { respondError(w, 400, "encode debe ser code o id"); return }
+	skip, _ := strconv.Atoi(q.Get("skip"))
+	if skip < 0 || skip >= sheet.Columns*sheet.Rows { skip = 0 }
+
+	var where string
+	var args []interface{}
+	if ids := q.Get("id"); ids != "" {
+		placeholders := []string{}
+		for _, part := range strings.Split(ids, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil { respondError(w, 400, "ID inválido: "+part); return }
+			placeholders = append(placeholders, "?")
+			args = append(args, id)
+		}
+		where = " WHERE v.device_id IN (" + strings.Join(placeholders, ", ") + ") "
+	} else {
+		where, args = deviceListFilter(r)
+	}
+	rows, err := db.Query(deviceSelectSQL+where+" ORDER BY v.building, v.floor, v.area, v.room, v.device_type, v.code", args...)
+	if err != nil { handleDbError(w, err); return }
+	defer rows.Close()
+	devices := []Device{}
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil { continue }
+		devices = append(devices, d)
+	}
+	if len(devices) == 0 { respondError(w, 404, "No hay equipos para etiquetar."); return }
+
+	var canvas labelCanvas
+	var pdf *PDF
+	svg := &svgLabelCanvas{}
+	if format == "pdf" {
+		pdf = NewPDF()
+		canvas = &pdfLabelCanvas{pdf}
+	} else {
+		canvas = svg
+	}
+
+	const inch = 72.0
+	perPage := sheet.Columns * sheet.Rows
+	for i, d := range devices {
+		slot := (i + skip) % perPage
+		if i == 0 || slot == 0 { canvas.NewPage() }
+		// Un código con acentos u otros caracteres que Code 128 no admite se imprimiría con '?' y no se podría buscar al escanearlo
+		value := fmt.Sprintf("ID-%d", d.ID)
+		if encode == "code" && d.Code != nil && code128Encodable(strings.TrimSpace(*d.Code)) { value = strings.TrimSpace(*d.Code) }
+		col, row := slot%sheet.Columns, slot/sheet.Columns
+		drawDeviceLabel(canvas, d, value,
+			(sheet.Left+float64(col)*sheet.HorizPitch)*inch, (sheet.Top+float64(row)*sheet.VertPitch)*inch,
+			sheet.Width*inch, sheet.Height*inch)
+	}
+
+	filename := "etiquetas_" + time.Now().Format("2006-01-02") + "." + format
+	w.Header().Set("Content-Disposition", `inline; filename="`+filename+`"`)
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		io.WriteString(w, svg.Output())
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	if err := pdf.Output(w); err != nil { log.Printf("Error generando etiquetas: %v", err) }
+}
+
+// --- IMPORTACIÓN MASIVA DE EQUIPOS ---
+
+// deviceImportColumns : Encabezados aceptados (normalizados con importHeaderKey) -> campo
+var deviceImportColumns = map[string]string{
+	"code": "code", "codigo": "code", "codigobiennacional": "code", "biennacional": "code",
+	"serial": "serial", "serie": "serial",
+	"type": "type", "tipo": "type",
+	"brand": "brand", "marca": "brand",
+	"model": "model", "modelo": "model",
+	"building": "building", "edificio": "building",
+	"floor": "floor", "piso": "floor",
+	"area": "area",
+	"room": "room", "departamento": "room", "habitacion": "room",
+	"os": "os", "so": "os", "sistemaoperativo": "os",
+	"ram": "ram",
+	"storage": "storage", "almacenamiento": "storage",
+	"processor": "processor", "procesador": "processor", "cpu": "processor",
+	"arch": "arch", "arquitectura": "arch",
+	"details": "details", "detalles": "details", "observaciones": "details",
+}
+
+var deviceImportRequired = []string{"type", "building", "floor", "area"}
+
+type ImportRow struct {
+	Row    int      `json:"row"`
+	Code   string   `json:"code"`
+	Status string   `json:"status"` // ok | error
+	Errors []string `json:"errors,omitempty"`
+	ID     int64    `json:"id,omitempty"`
+}
+
+type ImportReport struct {
+	Success   bool           `json:"success"`
+	DryRun    bool           `json:"dry_run"`
+	Committed bool           `json:"committed"`
+	Total     int            `json:"total"`
+	Imported  int            `json:"imported"`
+	Failed    int            `json:"failed"`
+	Created   map[string]int `json:"created"` // Registros de catálogo creados por tabla
+	Rows      []ImportRow    `json:"rows"`
+}
+
+// importHeaderKey : "Código Bien Nacional" -> "codigobiennacional"
+func importHeaderKey(s string) string {
+	s = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(s, "\ufeff")))
+	s = strings.NewReplacer("á", "a", "é", "e", "í", "i", "ó", "o", "ú", "u", "ñ", "n").Replace(s)
+	var b strings.Builder
+	for _, c := range s {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') { b.WriteRune(c) }
+	}
+	return b.String()
+}
+
+// readImportFile : Filas de un CSV (separado por ',' o ';') o de la primera hoja de un XLSX
+func readImportFile(data []byte, filename string) ([][]string, error) {
+	if bytes.HasPrefix(data, []byte("PK")) || strings.HasSuffix(strings.ToLower(filename), ".xlsx") {
+		return readXLSX(data)
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	firstLine := data
+	if i := bytes.IndexByte(data, '\n'); i >= 0 { firstLine = data[:i] }
+	cr := csv.NewReader(bytes.NewReader(data))
+	if bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) { cr.Comma = ';' }
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	rows, err := cr.ReadAll()
+	if err != nil { return nil, fmt.Errorf("CSV inválido: %v", err) }
+	return rows, nil
+}
+
+// normalizeArch : "64", "x64", "64 bits" -> "64 bits"
+func normalizeArch(s string) (string, bool) {
+	switch strings.ToLower(strings.ReplaceAll(s, " ", "")) {
+	case "32", "32bits", "x86", "i386":
+		return "32 bits", true
+	case "64", "64bits", "x64", "amd64":
+		return "64 bits", true
+	}
+	return "", false
+}
+
+// deviceImporter : Resuelve (o crea) los registros de catálogo dentro de la transacción de importación
+type deviceImporter struct {
+	tx      *sql.Tx
+	create  bool
+	created []struct{ Table string; ID int64 }
+	revived []int64 // Ubicaciones reactivadas desde la papelera
+}
+
+// lookup : ID del registro con ese nombre (sin distinguir mayúsculas), bajo parentCol = parentID si se indica.
+// Un nombre vacío devuelve nil sin error.
+func (im *deviceImporter) lookup(table, col, label, value, parentCol string, parentID interface{}) (interface{}, string) {
+	if value == "" { return nil, "" }
+	query := fmt.Sprintf("SELECT id, deleted_at FROM %s WHERE %s = ? COLLATE NOCASE", table, col)
+	args := []interface{}{value}
+	if parentCol != "" {
+		query += fmt.Sprintf(" AND %s = ?", parentCol)
+		args = append(args, parentID)
+	}
+	var id int64
+	var deleted sql.NullString
+	err := im.tx.QueryRow(query+" ORDER BY deleted_at IS NOT NULL, id LIMIT 1", args...).Scan(&id, &deleted)
+	if err == nil && !deleted.Valid { return id, "" }
+	if err != nil && err != sql.ErrNoRows { return nil, err.Error() }
+	if !im.create {
+		if err == nil { return nil, fmt.Sprintf("%s '%s' está en la papelera", label, value) }
+		return nil, fmt.Sprintf("%s '%s' no existe", label, value)
+	}
+
+	var res sql.Result
+	if parentCol != "" {
+		res, err = im.tx.Exec(fmt.Sprintf("INSERT INTO %s (%s, %s) VALUES (?, ?)", table, parentCol, col), parentID, value)
+	} else {
+		res, err = im.tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (?)", table, col), value)
+	}
+	if err != nil { return nil, fmt.Sprintf("%s '%s': %v", label, value, err) }
+	id, _ = res.LastInsertId()
+	im.created = append(im.created, struct{ Table string; ID int64 }{table, id})
+	return id, ""
+}
+
+// location : Ubicacion para el área y departamento (se crea o se reactiva como en el formulario)
+func (im *deviceImporter) location(idArea, idRoom interface{}) (int64, string) {
+	var id int64
+	var deleted sql.NullString
+	var err error
+	if idRoom != nil {
+		err = im.tx.QueryRow("SELECT id, deleted_at FROM Ubicacion WHERE id_area = ? AND id_room = ? ORDER BY deleted_at IS NOT NULL, id LIMIT 1", idArea, idRoom).Scan(&id, &deleted)
+	} else {
+		err = im.tx.QueryRow("SELECT id, deleted_at FROM Ubicacion WHERE id_area = ? AND id_room IS NULL ORDER BY deleted_at IS NOT NULL, id LIMIT 1", idArea).Scan(&id, &deleted)
+	}
+	if err == nil {
+		if deleted.Valid {
+			im.tx.Exec("UPDATE Ubicacion SET deleted_at = NULL WHERE id = ?", id)
+			im.revived = append(im.revived, id)
+		}
+		return id, ""
+	}
+	if err != sql.ErrNoRows { return 0, err.Error() }
+	res, err := im.tx.Exec("INSERT INTO Ubicacion (id_area, id_room) VALUES (?, ?)", idArea, idRoom)
+	if err != nil { return 0, "Ubicación: " + err.Error() }
+	id, _ = res.LastInsertId()
+	im.created = append(im.created, struct{ Table string; ID int64 }{"Ubicacion", id})
+	return id, ""
+}
+
+// handleDeviceImport : Alta masiva de equipos desde CSV o XLSX (campo "file" o cuerpo crudo).
+// Todo o nada: si alguna fila falla (o ?dry_run=1) se revierte la transacción y solo se devuelve el reporte.
+// ?create_missing=1 crea los tipos, marcas, modelos, especificaciones y ubicaciones que no existan.
+func handleDeviceImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { respondError(w, 405, "Método no permitido"); return }
+	dryRun := r.URL.Query().Get("dry_run") == "1" || r.URL.Query().Get("dry_run") == "true"
+	createMissing := r.URL.Query().Get("create_missing") == "1" || r.URL.Query().Get("create_missing") == "true"
+
+	r.Body = http.MaxBytesReader(w, r.Body, 10<<20)
+	var data []byte
+	var filename string
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		file, header, errFile := r.FormFile("file")
+		if errFile != nil { respondError(w, 400, "Archivo requerido (campo 'file')"); return }
+		defer file.Close()
+		filename = header.Filename
+		data, err = io.ReadAll(file)
+	} else {
+		data, err = io.ReadAll(r.Body)
+	}
+	if err != nil { respondError(w, 400, "No se pudo leer el archivo (máx. 10 MB)"); return }
+	if len(bytes.TrimSpace(data)) == 0 { respondError(w, 400, "El archivo está vacío"); return }
+
+	rows, err := readImportFile(data, filename)
+	if err != nil { respondError(w, 400, err.Error()); return }
+	if len(rows) < 2 { respondError(w, 400, "El archivo no tiene filas de datos"); return }
+
+	cols := map[string]int{}
+	for i, h := range rows[0] {
+		if field, ok := deviceImportColumns[importHeaderKey(h)]; ok {
+			if _, dup := cols[field]; !dup { cols[field] = i }
+		}
+	}
+	missing := []string{}
+	for _, f := range deviceImportRequired {
+		if _, ok := cols[f]; !ok { missing = append(missing, f) }
+	}
+	if len(missing) > 0 {
+		respondError(w, 400, "Faltan columnas obligatorias: "+strings.Join(missing, ", "))
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil { handleDbError(w, err); return }
+	defer tx.Rollback()
+	im := &deviceImporter{tx: tx, create: createMissing}
+
+	report := ImportReport{DryRun: dryRun, Created: map[string]int{}, Rows: []ImportRow{}}
+	seenCodes := map[string]int{}
+	for n, rec := range rows[1:] {
+		get := func(field string) string {
+			if i, ok := cols[field]; ok && i < len(rec) { return strings.TrimSpace(rec[i]) }
+			return ""
+		}
+		empty := true
+		for _, v := range rec {
+			if strings.TrimSpace(v) != "" { empty = false; break }
+		}
+		if empty { continue }
+
+		row := ImportRow{Row: n + 2, Code: get("code")}
+		fail := func(msg string) { row.Errors = append(row.Errors, msg) }
+		report.Total++
+
+		if row.Code != "" {
+			key := strings.ToLower(row.Code)
+			if prev, ok := seenCodes[key]; ok {
+				fail(fmt.Sprintf("Código repetido en el archivo (fila %d)", prev))
+			} else {
+				seenCodes[key] = row.Row
+				var existing int64
+				if tx.QueryRow("SELECT id FROM Dispositivo WHERE code = ? COLLATE NOCASE AND deleted_at IS NULL", row.Code).Scan(&existing) == nil {
+					fail(fmt.Sprintf("El código ya pertenece al equipo #%d", existing))
+				}
+			}
+		}
+		for _, f := range deviceImportRequired {
+			if get(f) == "" { fail(fmt.Sprintf("Columna '%s' vacía", f)) }
+		}
+
+		var arch interface{}
+		if a := get("arch"); a != "" {
+			if norm, ok := normalizeArch(a); ok { arch = norm } else { fail(fmt.Sprintf("Arquitectura '%s' inválida (32 o 64 bits)", a)) }
+		}
+
+		idType, e := im.lookup("Tipo", "type", "Tipo", get("type"), "", nil)
+		if e != "" { fail(e) }
+
+		idBrand, e := im.lookup("Marca", "brand", "Marca", get("brand"), "", nil)
+		if e != "" { fail(e) }
+		var idModel interface{}
+		if model := get("model"); model != "" {
+			if get("brand") == "" {
+				fail("El modelo requiere una marca")
+			} else if idBrand != nil {
+				var otherBrand string
+				errOther := tx.QueryRow(`SELECT b.brand FROM Modelo m JOIN Marca b ON m.id_brand = b.id 
+					WHERE m.model = ? COLLATE NOCASE AND m.id_brand != ? AND m.deleted_at IS NULL LIMIT 1`, model, idBrand).Scan(&otherBrand)
+				var exists int
+				tx.QueryRow("SELECT COUNT(*) FROM Modelo WHERE model = ? COLLATE NOCASE AND id_brand = ? AND deleted_at IS NULL", model, idBrand).Scan(&exists)
+				if exists == 0 && errOther == nil {
+					fail(fmt.Sprintf("El modelo '%s' pertenece a la marca '%s', no a '%s'", model, otherBrand, get("brand")))
+				} else if idModel, e = im.lookup("Modelo", "model", "Modelo", model, "id_brand", idBrand); e != "" {
+					fail(e)
+				}
+			}
+		}
+
+		var idLocation int64
+		idBuilding, e := im.lookup("Edificio", "building", "Edificio", get("building"), "", nil)
+		if e != "" { fail(e) }
+		if idBuilding != nil {
+			idFloor, e := im.lookup("Piso", "floor", "Piso", get("floor"), "id_building", idBuilding)
+			if e != "" { fail(e) }
+			if idFloor != nil {
+				idArea, e := im.lookup("Area", "area", "Área", get("area"), "id_floor", idFloor)
+				if e != "" { fail(e) }
+				if idArea != nil {
+					idRoom, e := im.lookup("Departamento", "room", "Departamento", get("room"), "id_area", idArea)
+					if e != "" { fail(e) }
+					if e == "" && len(row.Errors) == 0 {
+						if idLocation, e = im.location(idArea, idRoom); e != "" { fail(e) }
+					}
+				}
+			}
+		}
+
+		idOS, e := im.lookup("Sistema_Operativo", "os", "Sistema operativo", get("os"), "", nil)
+		if e != "" { fail(e) }
+		idRAM, e := im.lookup("RAM", "ram", "RAM", get("ram"), "", nil)
+		if e != "" { fail(e) }
+		idStorage, e := im.lookup("Almacenamiento", "storage", "Almacenamiento", get("storage"), "", nil)
+		if e != "" { fail(e) }
+		idProcessor, e := im.lookup("Procesador", "processor", "Procesador", get("processor"), "", nil)
+		if e != "" { fail(e) }
+
+		if len(row.Errors) == 0 {
+			res, err := tx.Exec(`INSERT INTO Dispositivo 
+				(code, id_type, id_location, id_brand, id_model, serial, id_os, id_ram, id_storage, id_processor, arch, details)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				nullIfEmpty(row.Code), idType, idLocation, idBrand, idModel, nullIfEmpty(get("serial")),
+				idOS, idRAM, idStorage, idProcessor, arch, nullIfEmpty(get("details")))
+			if err != nil {
+				fail(err.Error())
+			} else {
+				row.ID, _ = res.LastInsertId()
+			}
+		}
+
+		if len(row.Errors) > 0 {
+			row.Status = "error"
+			row.ID = 0
+			report.Failed++
+		} else {
+			row.Status = "ok"
+			report.Imported++
+		}
+		report.Rows = append(report.Rows, row)
+	}
+
+	for _, c := range im.created { report.Created[c.Table]++ }
+	report.Success = report.Failed == 0 && report.Total > 0
+	if !report.Success || dryRun {
+		if dryRun {
+			for i := range report.Rows { report.Rows[i].ID = 0 }
+		}
+		respondJSON(w, report)
+		return
+	}
+	if err := tx.Commit(); err != nil { handleDbError(w, err); return }
+	report.Committed = true
+
+	for _, c := range im.created {
+		recordAudit(r, c.Table, c.ID, "create", nil, snapshotRow(c.Table, c.ID))
+	}
+	for _, id := range im.revived {
+		recordAudit(r, "Ubicacion", id, "restore", nil, snapshotRow("Ubicacion", id))
+	}
+	for _, row := range report.Rows {
+		recordAudit(r, "Dispositivo", row.ID, "create", nil, snapshotRow("Dispositivo", row.ID))
+	}
+	respondJSON(w, report)
+}
+
+// deviceStatusSubQuery : El equipo tiene un ticket pendiente (En Taller)
+const deviceStatusSubQuery = "(SELECT 1 FROM Taller t WHERE t.id_device = v.device_id AND t.status = 'pending' AND t.deleted_at IS NULL)"
+
+// deviceSelectSQL : Equipo con su ubicación, especificaciones y estado (listado, hoja de vida y exportación)
+const deviceSelectSQL = `
+			SELECT 
+				v.device_id, v.code, v.device_type, v.brand, v.model, v.serial,
+				v.building, v.floor, v.area, v.room,
+				v.id_building, v.id_floor, v.id_area, v.id_room,
+				v.os, v.ram, v.storage, v.processor, v.arch, v.details,
+				CASE WHEN EXISTS ` + deviceStatusSubQuery + ` THEN 'workshop' ELSE 'operational' END,
+				CASE WHEN EXISTS ` + deviceStatusSubQuery + ` THEN 'En Taller' ELSE 'Operativo' END
+			FROM Vista_Datos_Dispositivo_Completo v
+			`
+
+func scanDevice(s rowScanner) (Device, error) {
+	var d Device
+	err := s.Scan(
+		&d.ID, &d.Code, &d.Type, &d.Brand, &d.Model, &d.Serial,
+		&d.Building, &d.Floor, &d.Area, &d.Room,
+		&d.IDBuilding, &d.IDFloor, &d.IDArea, &d.IDRoom,
+		&d.OS, &d.RAM, &d.Storage, &d.CPU, &d.Arch, &d.Details,
+		&d.Status, &d.StatusLabel)
+	return d, err
+}
+
+// deviceTrackedFields : Columnas de Dispositivo cuyo historial se muestra en la Hoja de Vida.
+// Lookup obtiene el texto legible del valor (vacío si la columna ya es texto).
+var deviceTrackedFields = []struct{ Column, Label, Lookup string }{
+	{"id_location", "Ubicación", `SELECT e.building || ' > ' || p.floor || ' > ' || a.area || COALESCE(' > ' || d.room, '') 
+		FROM Ubicacion u JOIN Area a ON u.id_area = a.id JOIN Piso p ON a.id_floor = p.id JOIN Edificio e ON p.id_building = e.id 
+		LEFT JOIN Departamento d ON u.id_room = d.id WHERE u.id = ?`},
+	{"id_type", "Tipo", "SELECT type FROM Tipo WHERE id = ?"},
+	{"id_brand", "Marca", "SELECT brand FROM Marca WHERE id = ?"},
+	{"id_model", "Modelo", "SELECT model FROM Modelo WHERE id = ?"},
+	{"id_os", "Sistema Operativo", "SELECT os FROM Sistema_Operativo WHERE id = ?"},
+	{"id_ram", "RAM", "SELECT ram FROM RAM WHERE id = ?"},
+	{"id_storage", "Almacenamiento", "SELECT storage FROM Almacenamiento WHERE id = ?"},
+	{"id_processor", "Procesador", "SELECT processor FROM Procesador WHERE id = ?"},
+	{"arch", "Arquitectura", ""},
+	{"code", "Código Bien Nacional", ""},
+	{"serial", "Serial", ""},
+}
+
+// describeDeviceValue : Texto legible de un valor de Dispositivo (nil si está vacío)
+func describeDeviceValue(lookup string, value interface{}) *string {
+	if value == nil { return nil }
+	var s string
+	if lookup == "" {
+		s = fmt.Sprint(value)
+	} else if err := db.QueryRow(lookup, value).Scan(&s); err != nil {
+		s = fmt.Sprintf("#%v", value)
+	}
+	return &s
+}
+
+// handleDeviceSubroutes : Rutas bajo /api/devices/{id}/... (Go 1.20 no tiene patrones en ServeMux)
+func handleDeviceSubroutes(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/devices/"), "/"), "/")
+	if len(parts) == 2 {
+		if id, err := strconv.Atoi(parts[0]); err == nil {
+			switch parts[1] {
+			case "history":
+				handleDeviceHistory(w, r, id)
+				return
+			case "changes":
+				handleDeviceChangesList(w, r, id)
+				return
+			}
+		}
+	}
+	respondError(w, 404, "Ruta no encontrada")
+}
+
+// handleDeviceHistory : Hoja de Vida: datos actuales, tickets, cambios de ubicación/especificaciones y totales
+func handleDeviceHistory(w http.ResponseWriter, r *http.Request, id int) {
+	h := DeviceHistory{Tickets: []Ticket{}, LocationChanges: []DeviceChange{}, SpecChanges: []DeviceChange{}}
+	var err error
+	h.Device, err = scanDevice(db.QueryRow(deviceSelectSQL+" WHERE v.device_id = ?", id))
+	if err == sql.ErrNoRows { respondError(w, 404, "Equipo no encontrado"); return }
+	if err != nil { handleDbError(w, err); return }
+
+	rows, err := db.Query(ticketSelectSQL+" WHERE t.id_device = ? AND t.deleted_at IS NULL ORDER BY t.date_in ASC, t.id ASC", id)
+	if err != nil { handleDbError(w, err); return }
+	for rows.Next() {
+		t, err := scanTicket(rows)
+		if err != nil { continue }
+		h.Tickets = append(h.Tickets, t)
+		h.Totals.Tickets++
+		switch t.Status {
+		case "repaired": h.Totals.Repaired++
+		case "unrepaired": h.Totals.Unrepaired++
+		default: h.Totals.Open++
+		}
+	}
+	rows.Close()
+	db.QueryRow(`SELECT CAST(COALESCE(SUM(julianday(COALESCE(date_out, date('now', 'localtime'))) - julianday(date_in)), 0) AS INTEGER) 
+		FROM Taller WHERE id_device = ? AND deleted_at IS NULL`, id).Scan(&h.Totals.DaysInWorkshop)
+
+	changes, err := deviceChanges(id)
+	if err != nil { handleDbError(w, err); return }
+	for _, c := range changes {
+		if c.Field == "id_location" {
+			h.LocationChanges = append(h.LocationChanges, c)
+		} else {
+			h.SpecChanges = append(h.SpecChanges, c)
+		}
+	}
+	respondJSON(w, h)
+}
+
+// deviceChanges : Cambios registrados en Dispositivo_Historial, en orden cronológico
+func deviceChanges(id int) ([]DeviceChange, error) {
+	rows, err := db.Query(`SELECT id_device, changed_at, username, field, old_value, new_value FROM Dispositivo_Historial 
+		WHERE id_device = ? ORDER BY id ASC`, id)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	return scanDeviceChanges(rows), nil
+}
+
+func scanDeviceChanges(rows *sql.Rows) []DeviceChange {
+	changes := []DeviceChange{}
+	for rows.Next() {
+		var c DeviceChange
+		var oldValue, newValue sql.NullString
+		if err := rows.Scan(&c.DeviceID, &c.Date, &c.Username, &c.Field, &oldValue, &newValue); err != nil { continue }
+		for _, f := range deviceTrackedFields {
+			if f.Column != c.Field { continue }
+			c.Label = f.Label
+			if oldValue.Valid { c.OldValue = describeDeviceValue(f.Lookup, oldValue.String) }
+			if newValue.Valid { c.NewValue = describeDeviceValue(f.Lookup, newValue.String) }
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// recordDeviceChanges : Registra en Dispositivo_Historial cada columna seguida que cambió entre dos snapshots
+func recordDeviceChanges(r *http.Request, id interface{}, before, after map[string]interface{}) {
+	if before == nil || after == nil { return }
+	var userID, username interface{}
+	if su := currentUser(r); su != nil { userID, username = su.ID, su.Username }
+	insertDeviceChanges(id, before, after, userID, username, time.Now().Format(TIMESTAMP_LAYOUT))
+}
+
+func insertDeviceChanges(id interface{}, before, after map[string]interface{}, userID, username interface{}, date string) {
+	for _, f := range deviceTrackedFields {
+		oldValue, newValue := historyValue(before[f.Column]), historyValue(after[f.Column])
+		if fmt.Sprint(oldValue) == fmt.Sprint(newValue) { continue }
+		_, err := db.Exec(`INSERT INTO Dispositivo_Historial (id_device, field, old_value, new_value, id_user, username, changed_at) 
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, id, f.Column, oldValue, newValue, userID, username, date)
+		if err != nil { log.Printf("Error registrando historial del equipo %v: %v", id, err) }
+	}
+}
+
+// historyValue : Valor de un snapshot como texto (los números de JSON llegan como float64)
+func historyValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// backfillDeviceHistory : Al crear Dispositivo_Historial, recupera los cambios ya registrados en la auditoría
+func backfillDeviceHistory() {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM Dispositivo_Historial").Scan(&count)
+	if count > 0 { return }
+
+	rows, err := db.Query(`SELECT entity_id, created_at, id_user, username, before_data, after_data FROM Auditoria 
+		WHERE entity = 'Dispositivo' AND action = 'update' AND before_data IS NOT NULL AND after_data IS NOT NULL ORDER BY id ASC`)
+	if err != nil { return }
+	type entry struct {
+		id, userID, username interface{}
+		date                 string
+		before, after        map[string]interface{}
+	}
+	entries := []entry{}
+	for rows.Next() {
+		var e entry
+		var before, after string
+		if err := rows.Scan(&e.id, &e.date, &e.userID, &e.username, &before, &after); err != nil { continue }
+		if json.Unmarshal([]byte(before), &e.before) != nil || json.Unmarshal([]byte(after), &e.after) != nil { continue }
+		entries = append(entries, e)
+	}
+	rows.Close()
+
+	for _, e := range entries {
+		insertDeviceChanges(e.id, e.before, e.after, e.userID, e.username, e.date)
+	}
+	if len(entries) > 0 { log.Printf("Historial de equipos: %d cambios recuperados de la auditoría", len(entries)) }
+}
+
+// handleDeviceChangesList : Cambios de un equipo (/api/devices/{id}/changes), opcionalmente ?field=
+func handleDeviceChangesList(w http.ResponseWriter, r *http.Request, id int) {
+	where := " WHERE id_device = ? "
+	args := []interface{}{id}
+	if field := r.URL.Query().Get("field"); field != "" { where += " AND field = ? "; args = append(args, field) }
+	rows, err := db.Query(`SELECT id_device, changed_at, username, field, old_value, new_value FROM Dispositivo_Historial `+where+` ORDER BY id ASC`, args...)
+	if err != nil { handleDbError(w, err); return }
+	defer rows.Close()
+	respondJSON(w, map[string]interface{}{"data": scanDeviceChanges(rows)})
+}
+
+// handleMovesReport : Traslados de equipos. Filtros: ?building=, ?area= (origen o destino), ?after=, ?before=
+func handleMovesReport(w http.ResponseWriter, r *http.Request) {
+	where := " WHERE h.field = 'id_location' "
+	args := []interface{}{}
+	if val := r.URL.Query().Get("after"); val != "" { where += " AND substr(h.changed_at, 1, 10) >= ? "; args = append(args, val) }
+	if val := r.URL.Query().Get("before"); val != "" { where += " AND substr(h.changed_at, 1, 10) <= ? "; args = append(args, val) }
+
+	locFilter := ""
+	if val := r.URL.Query().Get("area"); val != "" {
+		locFilter = "SELECT u.id FROM Ubicacion u WHERE u.id_area = ?"
+		args = append(args, val, val)
+	} else if val := r.URL.Query().Get("building"); val != "" {
+		locFilter = "SELECT u.id FROM Ubicacion u JOIN Area a ON u.id_area = a.id JOIN Piso p ON a.id_floor = p.id WHERE p.id_building = ?"
+		args = append(args, val, val)
+	}
+	if locFilter != "" {
+		where += fmt.Sprintf(" AND (CAST(h.old_value AS INTEGER) IN (%s) OR CAST(h.new_value AS INTEGER) IN (%s)) ", locFilter, locFilter)
+	}
+
+	rows, err := db.Query(`SELECT h.id_device, h.changed_at, h.username, h.field, h.old_value, h.new_value,
+			(SELECT type FROM Tipo WHERE id = d.id_type), d.code, d.serial
+		FROM Dispositivo_Historial h JOIN Dispositivo d ON h.id_device = d.id `+where+` ORDER BY h.changed_at DESC, h.id DESC`, args...)
+	if err != nil { handleDbError(w, err); return }
+	defer rows.Close()
+
+	moves := []DeviceMove{}
+	for rows.Next() {
+		var m DeviceMove
+		var oldValue, newValue sql.NullString
+		if err := rows.Scan(&m.DeviceID, &m.Date, &m.Username, &m.Field, &oldValue, &newValue, &m.DeviceType, &m.Code, &m.Serial); err != nil { continue }
+		m.Label = deviceTrackedFields[0].Label
+		if oldValue.Valid { m.OldValue = describeDeviceValue(deviceTrackedFields[0].Lookup, oldValue.String) }
+		if newValue.Valid { m.NewValue = describeDeviceValue(deviceTrackedFields[0].Lookup, newValue.String) }
+		moves = append(moves, m)
+	}
+	respondJSON(w, map[string]interface{}{"data": moves})
+}
+
+// --- HANDLERS TICKETS ---
+
+func handleTicketsCRUD(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if page < 1 { page = 1 }
+		if limit < 1 { limit = 10 }
+		offset := (page - 1) * limit
+
+		where, args := ticketListFilter(r)
+
+		var total int
+		db.QueryRow("SELECT COUNT(*) FROM Taller t JOIN Vista_Datos_Dispositivo_Completo v ON t.id_device=v.device_id "+where, args...).Scan(&total)
+
+		query := ticketSelectSQL + where + ` ORDER BY t.date_in DESC LIMIT ? OFFSET ?`
+		
+		args = append(args, limit, offset)
+		rows, err := db.Query(query, args...)
+		if err != nil { handleDbError(w, err); return }
+		defer rows.Close()
+
+		tickets := []Ticket{}
+		for rows.Next() {
+			t, err := scanTicket(rows)
+			if err != nil { continue }
+			tickets = append(tickets, t)
+		}
+		respondJSON(w, TicketResponse{Data: tickets, Total: total, Page: page, Limit: limit})
+
+	} else if r.Method == "POST" {
+		var t Ticket
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil { respondError(w, 400, "JSON inválido"); return }
+		t.DetailsIn = strings.TrimSpace(t.DetailsIn)
+		if msg := validateTicketEntry(t.DateIn, t.DetailsIn); msg != "" { respondError(w, 400, msg); return }
+		var exists int
+		db.QueryRow("SELECT COUNT(*) FROM Dispositivo WHERE id = ? AND deleted_at IS NULL", t.DeviceID).Scan(&exists)
+		if exists == 0 { respondError(w, 400, "El equipo indicado no existe."); return }
+		if respondOpenTicketConflict(w, t.DeviceID, 0) { return }
+
+		// Quien registra el ingreso lo recibe y queda asignado; solo un administrador puede asignarlo a otro
+		su := currentUser(r)
+		var receivedBy, assignedTo interface{}
+		if su != nil { receivedBy, assignedTo = su.ID, su.ID }
+		if t.AssignedTo != nil && su != nil && su.Role == ROLE_ADMIN {
+			if !userExists(*t.AssignedTo) { respondError(w, 400, "El técnico asignado no existe."); return }
+			assignedTo = *t.AssignedTo
+		}
+
+		res, err := db.Exec("INSERT INTO Taller (id_device, date_in, details_in, status, received_by, assigned_to) VALUES (?, ?, ?, 'pending', ?, ?)",
+			t.DeviceID, t.DateIn, t.DetailsIn, receivedBy, assignedTo)
+		if err != nil {
+			// Otra petición pudo abrir un ticket para el equipo entre la validación y el INSERT (idx_taller_pending_device)
+			if !respondOpenTicketConflict(w, t.DeviceID, 0) { handleDbError(w, err) }
+			return
+		}
+		newID, _ := res.LastInsertId()
+		recordAudit(r, "Taller", newID, "create", nil, snapshotRow("Taller", newID))
+		respondTicket(w, newID)
+	} else if r.Method == "PUT" {
+		id := r.URL.Query().Get("id")
+		if id == "" { respondError(w, 400, "ID requerido"); return }
+		var t map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil { respondError(w, 400, "JSON inválido"); return }
+
+		var current, dateIn string
+		err := db.QueryRow("SELECT status, date_in FROM Taller WHERE id = ? AND deleted_at IS NULL", id).Scan(&current, &dateIn)
+		if err == sql.ErrNoRows { respondError(w, 404, "Ticket no encontrado"); return }
+		if err != nil { handleDbError(w, err); return }
+		// Un ticket cerrado es historial: solo se modifica tras reabrirlo (/api/tickets/reopen)
+		if current != "pending" {
+			respondError(w, 409, "El ticket ya está cerrado. Un administrador debe reabrirlo para modificarlo.")
+			return
+		}
+
+		before := snapshotRow("Taller", id)
+		action := "update"
+		if t["status"] != nil {
+			next, _ := t["status"].(string)
+			dateOut, _ := t["date_out"].(string)
+			detailsOut, _ := t["details_out"].(string)
+			detailsOut = strings.TrimSpace(detailsOut)
+			if msg := validateTicketTransition(current, next, dateIn, dateOut, detailsOut); msg != "" { respondError(w, 409, msg); return }
+
+			tx, err := db.Begin()
+			if err != nil { handleDbError(w, err); return }
+			defer tx.Rollback()
+			var closer interface{}
+			if su := currentUser(r); su != nil { closer = su.ID }
+			res, err := tx.Exec("UPDATE Taller SET status=?, date_out=?, details_out=?, assigned_to=COALESCE(assigned_to, ?) WHERE id=? AND status=?",
+				next, dateOut, detailsOut, closer, id, current)
+			if err != nil { handleDbError(w, err); return }
+			if n, _ := res.RowsAffected(); n == 0 { respondError(w, 409, "El ticket cambió de estado mientras se editaba. Recargue e intente de nuevo."); return }
+			if err := recordTicketTransition(tx, r, id, current, next, dateOut, detailsOut, nil); err != nil { handleDbError(w, err); return }
+			if err := tx.Commit(); err != nil { handleDbError(w, err); return }
+			action = "close"
+		} else {
+			newDateIn, _ := t["date_in"].(string)
+			detailsIn, _ := t["details_in"].(string)
+			detailsIn = strings.TrimSpace(detailsIn)
+			if msg := validateTicketEntry(newDateIn, detailsIn); msg != "" { respondError(w, 400, msg); return }
+
+			// Los técnicos son opcionales en el cuerpo: null los quita, un ID debe ser un usuario existente
+			sets := "date_in=?, details_in=?"
+			args := []interface{}{newDateIn, detailsIn}
+			for _, col := range []string{"received_by", "assigned_to"} {
+				val, ok := t[col]
+				if !ok { continue }
+				if val != nil {
+					f, isNum := val.(float64)
+					if !isNum || f != math.Trunc(f) || !userExists(int(f)) { respondError(w, 400, "El técnico indicado no existe."); return }
+					val = int(f)
+				}
+				sets += ", " + col + "=?"
+				args = append(args, val)
+			}
+			_, err = db.Exec("UPDATE Taller SET "+sets+" WHERE id=?", append(args, id)...)
+			if err != nil { handleDbError(w, err); return }
+		}
+		recordAudit(r, "Taller", id, action, before, snapshotRow("Taller", id))
+		respondTicket(w, id)
+	} else if r.Method == "DELETE" {
+		id := r.URL.Query().Get("id")
+		if id == "" { respondError(w, 400, "ID requerido"); return }
+		before := snapshotRow("Taller", id)
+		err := softDelete("Taller", id)
+		if err != nil { handleDbError(w, err); return }
+		recordAudit(r, "Taller", id, "delete", before, nil)
+		respondJSON(w, map[string]bool{"success": true})
+	}
+}
+
+// ticketTransitions : Cambios de estado permitidos por PUT /api/tickets.
+// Volver de un cierre a 'pending' solo es posible con /api/tickets/reopen.
+var ticketTransitions = map[string][]string{
+	"pending": {"repaired", "unrepaired"},
+}
+
+// validateTicketTransition : Mensaje de error si el cambio de estado no es válido, vacío si lo es
+func validateTicketTransition(from, to, dateIn, dateOut, detailsOut string) string {
+	allowed := false
+	for _, s := range ticketTransitions[from] {
+		if s == to { allowed = true }
+	}
+	if !allowed { return fmt.Sprintf("Transición no permitida: de '%s' a '%s'.", from, to) }
+	if _, err := time.Parse("2006-01-02", dateOut); err != nil { return "Para cerrar el ticket indique la fecha de salida (AAAA-MM-DD)." }
+	if dateOut < dateIn { return "La fecha de salida no puede ser anterior a la fecha de ingreso." }
+	if detailsOut == "" { return "Para cerrar el ticket indique los detalles de salida." }
+	return ""
+}
+
+// ticketSelectSQL : Ticket con los datos del equipo y su ubicación (listado y ticket individual)
+const ticketSelectSQL = `
+			SELECT t.id, t.id_device, t.date_in, t.details_in, t.status, t.date_out, t.details_out,
+			       v.code, v.serial, v.brand, v.model, v.device_type,
+				   v.building, v.floor, v.area, v.room,
+				   v.os, v.ram, v.storage, v.processor, v.arch,
+				   t.received_by, ur.full_name, t.assigned_to, ua.full_name,
+				   (SELECT n.note FROM Taller_Nota n WHERE n.id_ticket = t.id ORDER BY n.id DESC LIMIT 1),
+				   (SELECT n.created_at FROM Taller_Nota n WHERE n.id_ticket = t.id ORDER BY n.id DESC LIMIT 1)
+			FROM Taller t
+			JOIN Vista_Datos_Dispositivo_Completo v ON t.id_device = v.device_id
+			LEFT JOIN Usuario ur ON t.received_by = ur.id
+			LEFT JOIN Usuario ua ON t.assigned_to = ua.id
+			`
+
+// rowScanner : *sql.Row o *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTicket(s rowScanner) (Ticket, error) {
+	var t Ticket
+	var dOut, detOut sql.NullString
+	err := s.Scan(&t.ID, &t.DeviceID, &t.DateIn, &t.DetailsIn, &t.Status, &dOut, &detOut,
+		&t.DeviceCode, &t.DeviceSerial, &t.DeviceBrand, &t.DeviceModel, &t.DeviceType,
+		&t.Building, &t.Floor, &t.Area, &t.Room,
+		&t.DeviceOS, &t.DeviceRAM, &t.DeviceStorage, &t.DeviceCPU, &t.DeviceArch,
+		&t.ReceivedBy, &t.ReceivedName, &t.AssignedTo, &t.AssignedName,
+		&t.LastNote, &t.LastNoteAt)
+	if dOut.Valid { t.DateOut = &dOut.String }
+	if detOut.Valid { t.DetailsOut = &detOut.String }
+	return t, err
+}
+
+// ticketListFilter : WHERE y argumentos de los filtros de tickets (listado y reporte PDF)
+func ticketListFilter(r *http.Request) (string, []interface{}) {
+	where := " WHERE t.deleted_at IS NULL "
+	args := []interface{}{}
+
+	status := r.URL.Query().Get("status")
+	if status == "history" {
+		where += " AND t.status IN ('repaired', 'unrepaired') "
+	} else if status != "" && status != "all" {
+		where += " AND t.status = ? "
+		args = append(args, status)
+	}
+
+	if val := r.URL.Query().Get("after"); val != "" {
+		where += " AND t.date_out >= ? "
+		args = append(args, val)
+	}
+	if val := r.URL.Query().Get("before"); val != "" {
+		where += " AND t.date_out <= ? "
+		args = append(args, val)
+	}
+
+	search := r.URL.Query().Get("search")
+	if search != "" {
+		term := "%" + search + "%"
+		where += ` AND (
+			v.code LIKE ? OR v.serial LIKE ? OR v.brand LIKE ? OR v.model LIKE ? OR 
+			v.building LIKE ? OR v.area LIKE ? OR 
+			t.details_in LIKE ? OR t.details_out LIKE ?
+		) `
+		for i := 0; i < 8; i++ { args = append(args, term) }
+	}
+	
+	if val := r.URL.Query().Get("type"); val != "" { where += " AND v.id_type = ? "; args = append(args, val) }
+	if val := r.URL.Query().Get("brand"); val != "" { where += " AND v.id_brand = ? "; args = append(args, val) }
+	if val := r.URL.Query().Get("assigned_to"); val != "" {
+		if val == "none" {
+			where += " AND t.assigned_to IS NULL "
+		} else {
+			where += " AND t.assigned_to = ? "; args = append(args, val)
+		}
+	}
+	return where, args
+}
+
+// respondTicket : Responde con el ticket completo tras crearlo o editarlo
+func respondTicket(w http.ResponseWriter, id interface{}) {
+	t, err := scanTicket(db.QueryRow(ticketSelectSQL+" WHERE t.id = ?", id))
+	if err != nil { handleDbError(w, err); return }
+	respondJSON(w, map[string]interface{}{"success": true, "id": t.ID, "data": t})
+}
+
+// validateTicketEntry : Fecha de ingreso ISO y falla reportada obligatoria
+func validateTicketEntry(dateIn, detailsIn string) string {
+	if _, err := time.Parse("2006-01-02", dateIn); err != nil { return "La fecha de ingreso debe tener el formato AAAA-MM-DD." }
+	if detailsIn == "" { return "Describa la falla o motivo del ingreso." }
+	return ""
+}
+
+// respondOpenTicketConflict : Responde 409 con el id del ticket pendiente del equipo, si existe otro distinto de exceptID
+func respondOpenTicketConflict(w http.ResponseWriter, deviceID, exceptID int) bool {
+	var openID int
+	err := db.QueryRow("SELECT id FROM Taller WHERE id_device = ? AND status = 'pending' AND deleted_at IS NULL AND id != ? LIMIT 1",
+		deviceID, exceptID).Scan(&openID)
+	if err != nil { return false }
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(409)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        fmt.Sprintf("Este equipo ya tiene un ticket abierto en el taller (Ticket #%d).", openID),
+		"open_ticket_id": openID,
+	})
+	return true
+}
+
+// recordTicketTransition : Guarda el cambio de estado en Taller_Estado dentro de la transacción
+func recordTicketTransition(tx *sql.Tx, r *http.Request, id interface{}, from, to string, dateOut, detailsOut, reason interface{}) error {
+	var userID interface{}
+	if su := currentUser(r); su != nil { userID = su.ID }
+	_, err := tx.Exec(`INSERT INTO Taller_Estado (id_ticket, from_status, to_status, date_out, details_out, reason, id_user, created_at) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, id, from, to, dateOut, detailsOut, reason, userID, time.Now().Format(TIMESTAMP_LAYOUT))
+	return err
+}
+
+// handleTicketReopen : Devuelve un ticket cerrado a 'pending'. El cierre anterior queda en Taller_Estado.
+func handleTicketReopen(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" { respondError(w, 400, "ID requerido"); return }
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	body.Reason = strings.TrimSpace(body.Reason)
+	if body.Reason == "" { respondError(w, 400, "Indique el motivo de la reapertura."); return }
+
+	var current string
+	var dateOut, detailsOut sql.NullString
+	err := db.QueryRow("SELECT status, date_out, details_out FROM Taller WHERE id = ? AND deleted_at IS NULL", id).Scan(&current, &dateOut, &detailsOut)
+	if err == sql.ErrNoRows { respondError(w, 404, "Ticket no encontrado"); return }
+	if err != nil { handleDbError(w, err); return }
+	if current == "pending" { respondError(w, 409, "El ticket ya está abierto."); return }
+	var deviceID int
+	db.QueryRow("SELECT id_device FROM Taller WHERE id = ?", id).Scan(&deviceID)
+	ticketID, _ := strconv.Atoi(id)
+	if respondOpenTicketConflict(w, deviceID, ticketID) { return }
+
+	before := snapshotRow("Taller", id)
+	tx, err := db.Begin()
+	if err != nil { handleDbError(w, err); return }
+	defer tx.Rollback()
+	if err := recordTicketTransition(tx, r, id, current, "pending", dateOut, detailsOut, body.Reason); err != nil { handleDbError(w, err); return }
+	_, err = tx.Exec("UPDATE Taller SET status = 'pending', date_out = NULL, details_out = NULL WHERE id = ?", id)
+	if err != nil { handleDbError(w, err); return }
+	if err := tx.Commit(); err != nil { handleDbError(w, err); return }
+
+	recordAudit(r, "Taller", id, "reopen", before, snapshotRow("Taller", id))
+	respondJSON(w, map[string]bool{"success": true})
+}
+
+// handleTicketTransitions : Historial de estados de un ticket (?id=)
+func handleTicketTransitions(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" { respondError(w, 400, "ID requerido"); return }
+	rows, err := db.Query(`SELECT e.id, e.from_status, e.to_status, e.date_out, e.details_out, e.reason, u.username, e.created_at
+		FROM Taller_Estado e LEFT JOIN Usuario u ON e.id_user = u.id
+		WHERE e.id_ticket = ? ORDER BY e.id ASC`, id)
+	if err != nil { handleDbError(w, err); return }
+	defer rows.Close()
+
+	items := []TicketTransition{}
+	for rows.Next() {
+		var e TicketTransition
+		if err := rows.Scan(&e.ID, &e.FromStatus, &e.ToStatus, &e.DateOut, &e.DetailsOut, &e.Reason, &e.Username, &e.CreatedAt); err != nil { continue }
+		items = append(items, e)
+	}
+	respondJSON(w, map[string]interface{}{"data": items})
+}
+
+// handleTicketNotes : Bitácora del ticket (?id=). GET lista en orden cronológico, POST agrega una nota.
+func handleTicketNotes(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" { respondError(w, 400, "ID requerido"); return }
+	var exists int
+	db.QueryRow("SELECT COUNT(*) FROM Taller WHERE id = ? AND deleted_at IS NULL", id).Scan(&exists)
+	if exists == 0 { respondError(w, 404, "Ticket no encontrado"); return }
+
+	if r.Method == "GET" {
+		rows, err := db.Query(`SELECT n.id, n.id_ticket, n.id_user, u.full_name, n.created_at, n.note
+			FROM Taller_Nota n LEFT JOIN Usuario u ON n.id_user = u.id
+			WHERE n.id_ticket = ? ORDER BY n.id ASC`, id)
+		if err != nil { handleDbError(w, err); return }
+		defer rows.Close()
+
+		notes := []TicketNote{}
+		for rows.Next() {
+			var n TicketNote
+			if err := rows.Scan(&n.ID, &n.TicketID, &n.UserID, &n.Author, &n.CreatedAt, &n.Note); err != nil { continue }
+			notes = append(notes, n)
+		}
+		respondJSON(w, map[string]interface{}{"data": notes})
+
+	} else if r.Method == "POST" {
+		var body struct {
+			Note string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil { respondError(w, 400, "JSON inválido"); return }
+		body.Note = strings.TrimSpace(body.Note)
+		if body.Note == "" { respondError(w, 400, "La nota no puede estar vacía."); return }
+		if utf8.RuneCountInString(body.Note) > 1000 { respondError(w, 400, "La nota no puede superar los 1000 caracteres."); return }
+
+		var userID interface{}
+		if su := currentUser(r); su != nil { userID = su.ID }
+		res, err := db.Exec("INSERT INTO Taller_Nota (id_ticket, id_user, created_at, note) VALUES (?, ?, ?, ?)",
+			id, userID, time.Now().Format(TIMESTAMP_LAYOUT), body.Note)
+		if err != nil { handleDbError(w, err); return }
+		newID, _ := res.LastInsertId()
+		recordAudit(r, "Taller_Nota", newID, "create", nil, snapshotRow("Taller_Nota", newID))
+		respondJSON(w, map[string]interface{}{"success": true, "id": newID})
+	}
+}
+
+// handleTicketParts : Repuestos de un ticket (?id=). POST solo con el ticket abierto; DELETE quita ?part_link=.
+func handleTicketParts(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" { respondError(w, 400, "ID requerido"); return }
+	var status string
+	var deviceID int
+	err := db.QueryRow("SELECT status, id_device FROM Taller WHERE id = ? AND deleted_at IS NULL", id).Scan(&status, &deviceID)
+	if err == sql.ErrNoRows { respondError(w, 404, "Ticket no encontrado"); return }
+	if err != nil { handleDbError(w, err); return }
+
+	if r.Method == "GET" {
+		rows, err := db.Query(`SELECT tr.id, tr.id_ticket, tr.id_part, p.part, tr.quantity, tr.serial_removed, tr.serial_installed, u.full_name, tr.created_at
+			FROM Taller_Repuesto tr JOIN Repuesto p ON tr.id_part = p.id LEFT JOIN Usuario u ON tr.id_user = u.id
+			WHERE tr.id_ticket = ? ORDER BY tr.id ASC`, id)
+		if err != nil { handleDbError(w, err); return }
+		defer rows.Close()
+
+		parts := []TicketPart{}
+		for rows.Next() {
+			var p TicketPart
+			if err := rows.Scan(&p.ID, &p.TicketID, &p.PartID, &p.Part, &p.Quantity, &p.SerialRemoved, &p.SerialInstalled, &p.Author, &p.CreatedAt); err != nil { continue }
+			parts = append(parts, p)
+		}
+		respondJSON(w, map[string]interface{}{"data": parts})
+		return
+	}
+
+	if status != "pending" { respondError(w, 409, "Solo se pueden modificar los repuestos de un ticket abierto."); return }
+
+	if r.Method == "POST" {
+		var req TicketPartRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil { respondError(w, 400, "JSON inválido"); return }
+		if req.Quantity == 0 { req.Quantity = 1 }
+		if req.Quantity < 0 { respondError(w, 400, "La cantidad debe ser mayor a cero."); return }
+		var exists int
+		db.QueryRow("SELECT COUNT(*) FROM Repuesto WHERE id = ? AND deleted_at IS NULL", req.PartID).Scan(&exists)
+		if exists == 0 { respondError(w, 400, "El repuesto indicado no existe."); return }
+
+		// Cambios de especificación que produce el repuesto sobre la ficha del equipo.
+		// Editar la ficha es exclusivo del administrador, igual que en PUT /api/devices.
+		if req.IDRAM != nil || req.IDStorage != nil {
+			if su := currentUser(r); su == nil || su.Role != ROLE_ADMIN {
+				respondError(w, 403, "Solo un administrador puede cambiar las especificaciones del equipo.")
+				return
+			}
+		}
+		specs := map[string]*int{"id_ram": req.IDRAM, "id_storage": req.IDStorage}
+		specTables := map[string]string{"id_ram": "RAM", "id_storage": "Almacenamiento"}
+		for col, val := range specs {
+			if val == nil { continue }
+			db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = ? AND deleted_at IS NULL", specTables[col]), *val).Scan(&exists)
+			if exists == 0 { respondError(w, 400, "La especificación indicada no existe."); return }
+		}
+
+		var userID interface{}
+		if su := currentUser(r); su != nil { userID = su.ID }
+		deviceBefore := snapshotRow("Dispositivo", deviceID)
+
+		tx, err := db.Begin()
+		if err != nil { handleDbError(w, err); return }
+		defer tx.Rollback()
+		res, err := tx.Exec(`INSERT INTO Taller_Repuesto (id_ticket, id_part, quantity, serial_removed, serial_installed, id_user, created_at) 
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, id, req.PartID, req.Quantity, nullIfEmpty(req.SerialRemoved), nullIfEmpty(req.SerialInstalled),
+			userID, time.Now().Format(TIMESTAMP_LAYOUT))
+		if err != nil { handleDbError(w, err); return }
+		deviceUpdated := false
+		for col, val := range specs {
+			if val == nil { continue }
+			if _, err := tx.Exec(fmt.Sprintf("UPDATE Dispositivo SET %s = ? WHERE id = ?", col), *val, deviceID); err != nil { handleDbError(w, err); return }
+			deviceUpdated = true
+		}
+		if err := tx.Commit(); err != nil { handleDbError(w, err); return }
+
+		newID, _ := res.LastInsertId()
+		recordAudit(r, "Taller_Repuesto", newID, "create", nil, snapshotRow("Taller_Repuesto", newID))
+		if deviceUpdated {
+			deviceAfter := snapshotRow("Dispositivo", deviceID)
+			recordAudit(r, "Dispositivo", deviceID, "update", deviceBefore, deviceAfter)
+			recordDeviceChanges(r, deviceID, deviceBefore, deviceAfter)
+		}
+		respondJSON(w, map[string]interface{}{"success": true, "id": newID, "device_updated": deviceUpdated})
+
+	} else if r.Method == "DELETE" {
+		link := r.URL.Query().Get("part_link")
+		if link == "" { respondError(w, 400, "Indique el repuesto a quitar (part_link)"); return }
+		before := snapshotRow("Taller_Repuesto", link)
+		res, err := db.Exec("DELETE FROM Taller_Repuesto WHERE id = ? AND id_ticket = ?", link, id)
+		if err != nil { handleDbError(w, err); return }
+		if n, _ := res.RowsAffected(); n == 0 { respondError(w, 404, "Repuesto no encontrado en este ticket"); return }
+		recordAudit(r, "Taller_Repuesto", link, "delete", before, nil)
+		respondJSON(w, map[string]bool{"success": true})
+	}
+}
+
+// handlePartsReport : Repuestos consumidos en un período (?period=, por defecto el actual) o rango ?after=&before=
+func handlePartsReport(w http.ResponseWriter, r *http.Request) {
+	after, before := r.URL.Query().Get("after"), r.URL.Query().Get("before")
+	var period *Period
+	if after == "" && before == "" {
+		var p Period
+		var err error
+		if code := r.URL.Query().Get("period"); code != "" {
+			err = db.QueryRow("SELECT code, date_ini, date_end, is_current FROM Periodo WHERE code = ?", code).Scan(&p.Code, &p.DateIni, &p.DateEnd, &p.IsCurrent)
+			if err == sql.ErrNoRows { respondError(w, 404, "Período no encontrado"); return }
+		} else {
+			p, err = currentPeriod()
+		}
+		if err == nil {
+			period = &p
+			after, before = p.DateIni, p.DateEnd
+		} else if err != sql.ErrNoRows {
+			handleDbError(w, err); return
+		}
+	}
+
+	where := " WHERE t.deleted_at IS NULL "
+	args := []interface{}{}
+	if after != "" { where += " AND substr(tr.created_at, 1, 10) >= ? "; args = append(args, after) }
+	if before != "" { where += " AND substr(tr.created_at, 1, 10) <= ? "; args = append(args, before) }
+
+	rows, err := db.Query(`SELECT p.id, p.part, SUM(tr.quantity), COUNT(DISTINCT tr.id_ticket)
+		FROM Taller_Repuesto tr 
+		JOIN Repuesto p ON tr.id_part = p.id 
+		JOIN Taller t ON tr.id_ticket = t.id `+where+`
+		GROUP BY p.id, p.part ORDER BY SUM(tr.quantity) DESC, p.part ASC`, args...)
+	if err != nil { handleDbError(w, err); return }
+	defer rows.Close()
+
+	items := []PartUsage{}
+	for rows.Next() {
+		var u PartUsage
+		if err := rows.Scan(&u.PartID, &u.Part, &u.Quantity, &u.Tickets); err != nil { continue }
+		items = append(items, u)
+	}
+	respondJSON(w, map[string]interface{}{"data": items, "period": period, "after": after, "before": before})
+}
+
+// --- CONFIGURACIÓN INSTITUCIONAL ---
+
+// settingDefaults : Claves de texto de Configuracion y su valor cuando no se han definido.
+// Las firmas vacías usan el primer administrador y el primer consultor.
+var settingDefaults = map[string]string{
+	"institution_name":      "UNEFA Núcleo Miranda - Sede Los Teques",
+	"header_lines":          strings.Join(reportHeaderLines, "\n"),
+	"signer_left_name":      "",
+	"signer_left_position":  "",
+	"signer_right_name":     "",
+	"signer_right_position": "",
+}
+
+// settingLogos : Logos subidos (PNG o JPEG en base64), por lado
+var settingLogos = map[string]string{"left": "logo_left", "right": "logo_right"}
+
+// getSetting : Valor guardado o, si no existe o está vacío, el valor por defecto
+func getSetting(key string) string {
+	var value sql.NullString
+	db.QueryRow("SELECT value FROM Configuracion WHERE setting = ?", key).Scan(&value)
+	if value.Valid && strings.TrimSpace(value.String) != "" { return value.String }
+	return settingDefaults[key]
+}
+
+// saveSetting : Inserta o reemplaza una clave (NULL la borra para volver al valor por defecto)
+func saveSetting(tx *sql.Tx, key string, value interface{}) error {
+	if value == nil {
+		_, err := tx.Exec("DELETE FROM Configuracion WHERE setting = ?", key)
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO Configuracion (setting, value, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(setting) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		key, value, time.Now().Format(TIMESTAMP_LAYOUT))
+	return err
+}
+
+// handleSettings : GET valores efectivos (con los valores por defecto aplicados); PUT cambia las claves enviadas
+func handleSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		settings := map[string]interface{}{}
+		for key := range settingDefaults { settings[key] = getSetting(key) }
+		for side, key := range settingLogos {
+			var exists int
+			db.QueryRow("SELECT COUNT(*) FROM Configuracion WHERE setting = ?", key).Scan(&exists)
+			settings["has_logo_"+side] = exists > 0
+		}
+		respondJSON(w, settings)
+
+	} else if r.Method == "PUT" {
+		var body map[string]*string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil { respondError(w, 400, "JSON inválido"); return }
+		for key, value := range body {
+			if _, ok := settingDefaults[key]; !ok { respondError(w, 400, "Clave de configuración desconocida: "+key); return }
+			if value != nil && utf8.RuneCountInString(*value) > 1000 { respondError(w, 400, "El valor de "+key+" es demasiado largo."); return }
+		}
+		if lines, ok := body["header_lines"]; ok && lines != nil && len(strings.Split(strings.TrimSpace(*lines), "\n")) > 8 {
+			respondError(w, 400, "El encabezado admite como máximo 8 líneas."); return
+		}
+
+		befores := map[string]map[string]interface{}{}
+		for key := range body { befores[key] = snapshotRowBy("Configuracion", "setting", key) }
+		tx, err := db.Begin()
+		if err != nil { handleDbError(w, err); return }
+		defer tx.Rollback()
+		for key, value := range body {
+			var v interface{}
+			if value != nil { v = nullIfEmpty(*value) }
+			if err := saveSetting(tx, key, v); err != nil { handleDbError(w, err); return }
+		}
+		if err := tx.Commit(); err != nil { handleDbError(w, err); return }
+		for key := range body {
+			after := snapshotRowBy("Configuracion", "setting", key)
+			action := "update"
+			if befores[key] == nil { action = "create" } else if after == nil { action = "delete" }
+			recordAudit(r, "Configuracion", key, action, befores[key], after)
+		}
+		respondJSON(w, map[string]bool{"success": true})
+	}
+}
+
+// handleSettingsLogo : Logo de los reportes, ?side=left|right. GET la imagen, POST la reemplaza (campo "file"
+// o cuerpo crudo, PNG o JPEG hasta 1 MB), DELETE vuelve al logo embebido.
+func handleSettingsLogo(w http.ResponseWriter, r *http.Request) {
+	side := r.URL.Query().Get("side")
+	key, ok := settingLogos[side]
+	if !ok { respondError(w, 400, "Indique side=left o side=right"); return }
+
+	if r.Method == "GET" {
+		data := reportLogoData(side)
+		if data == nil { respondError(w, 404, "Sin logo"); return }
+		w.Header().Set("Content-Type", http.DetectContentType(data))
+		w.Write(data)
+
+	} else if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20+4096)
+		var data []byte
+		var err error
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			file, _, errFile := r.FormFile("file")
+			if errFile != nil { respondError(w, 400, "Archivo requerido (campo 'file', máx. 1 MB)"); return }
+			defer file.Close()
+			data, err = io.ReadAll(file)
+		} else {
+			data, err = io.ReadAll(r.Body)
+		}
+		if err != nil || len(data) == 0 { respondError(w, 400, "No se pudo leer la imagen (máx. 1 MB)"); return }
+		if _, err := loadPDFImage(data); err != nil { respondError(w, 400, "Imagen inválida: "+err.Error()); return }
+
+		tx, err := db.Begin()
+		if err != nil { handleDbError(w, err); return }
+		defer tx.Rollback()
+		if err := saveSetting(tx, key, base64.StdEncoding.EncodeToString(data)); err != nil { handleDbError(w, err); return }
+		if err := tx.Commit(); err != nil { handleDbError(w, err); return }
+		// No se guarda la imagen en la auditoría, solo su tamaño
+		recordAudit(r, "Configuracion", key, "update", nil, map[string]interface{}{"setting": key, "bytes": len(data), "type": http.DetectContentType(data)})
+		respondJSON(w, map[string]bool{"success": true})
+
+	} else if r.Method == "DELETE" {
+		res, err := db.Exec("DELETE FROM Configuracion WHERE setting = ?", key)
+		if err != nil { handleDbError(w, err); return }
+		if n, _ := res.RowsAffected(); n > 0 {
+			recordAudit(r, "Configuracion", key, "delete", map[string]interface{}{"setting": key}, nil)
+		}
+		respondJSON(w, map[string]bool{"success": true})
+	}
+}
+
+// --- REPORTES PDF ---
+
+// reportHeaderLines : Encabezado institucional por defecto (configurable en header_lines)
+var reportHeaderLines = []string{
+	"MINISTERIO DEL PODER POPULAR PARA LA DEFENSA",
+	"UNIVERSIDAD NACIONAL EXPERIMENTAL POLITÉCNICA DE LA FUERZA ARMADA",
+	"NÚCLEO MIRANDA - SEDE LOS TEQUES",
+	"COORDINACIÓN DE TECNOLOGÍA Y SOPORTE",
+	"TECNOLOGÍA, INFORMACIÓN Y COMUNICACIÓN",
+	"SOPORTE TÉCNICO",
+}
+
+// reportLogoFiles : Logos izquierdo y derecho embebidos. Los originales son AVIF, que la biblioteca estándar
+// no decodifica: se usa la primera versión PNG o JPEG con el mismo nombre que exista en static/public.
+var reportLogoFiles = [2]string{"static/public/logo-fuerzas-armadas", "static/public/logo-unefa"}
+
+type reportSigner struct{ Name, Position string }
+
+// reportHeader : Líneas del encabezado según la configuración
+func reportHeader() []string {
+	lines := []string{}
+	for _, line := range strings.Split(getSetting("header_lines"), "\n") {
+		if line = strings.TrimSpace(line); line != "" { lines = append(lines, line) }
+	}
+	return lines
+}
+
+// reportSigners : Firmas al pie según la configuración. Lo que no esté configurado se toma, como antes en
+// el frontend, del primer administrador (izquierda) y del primer consultor (derecha).
+func reportSigners() [2]reportSigner {
+	signers := [2]reportSigner{}
+	for i, def := range []struct{ side, role string }{{"left", "admin"}, {"right", "viewer"}} {
+		side := def.side
+		s := reportSigner{"NOMBRE NO DISPONIBLE", "CARGO NO DISPONIBLE"}
+		var name, position string
+		if db.QueryRow("SELECT full_name, COALESCE(position, '') FROM Usuario WHERE rol = ? ORDER BY id LIMIT 1", def.role).Scan(&name, &position) == nil {
+			s.Name = name
+			if position != "" { s.Position = position }
+		}
+		if v := getSetting("signer_" + side + "_name"); v != "" { s.Name = v }
+		if v := getSetting("signer_" + side + "_position"); v != "" { s.Position = v }
+		s.Name, s.Position = strings.ToUpper(s.Name), strings.ToUpper(s.Position)
+		signers[i] = s
+	}
+	return signers
+}
+
+// reportLogoData : Logo subido en la configuración o, si no hay, la versión PNG/JPEG embebida
+func reportLogoData(side string) []byte {
+	var encoded string
+	if db.QueryRow("SELECT value FROM Configuracion WHERE setting = ?", settingLogos[side]).Scan(&encoded) == nil {
+		if data, err := base64.StdEncoding.DecodeString(encoded); err == nil { return data }
+	}
+	base := reportLogoFiles[0]
+	if side == "right" { base = reportLogoFiles[1] }
+	for _, ext := range []string{".png", ".jpg", ".jpeg"} {
+		if data, err := embeddedFiles.ReadFile(base + ext); err == nil { return data }
+	}
+	return nil
+}
+
+func reportLogos() [2]*pdfImage {
+	logos := [2]*pdfImage{}
+	for i, side := range []string{"left", "right"} {
+		if data := reportLogoData(side); data != nil {
+			logos[i], _ = loadPDFImage(data)
+		}
+	}
+	return logos
+}
+
+// reportCell : Celda de tabla; cada línea puede ir en negrita
+type reportCell []reportLine
+
+type reportLine struct {
+	Text string
+	Bold bool
+}
+
+const (
+	reportMargin   = 42.5 // 15 mm
+	reportWidth    = pdfPageWidth - 2*reportMargin
+	reportBottom   = pdfPageHeight - reportMargin - 24 // Límite del contenido, sobre el pie de página
+	reportFontSize = 8.0
+	reportLeading  = 9.5
+)
+
+// reportWriter : Páginas con el encabezado institucional que avanzan y saltan de página según el contenido
+type reportWriter struct {
+	pdf    *PDF
+	title  string
+	header []string
+	logos  [2]*pdfImage
+	y      float64
+	top    float64 // Primer y libre de la página actual, tras onNewPage
+	onNewPage func() // Ej. repetir el encabezado de una tabla
+}
+
+func newReportWriter(title string) *reportWriter {
+	rw := &reportWriter{pdf: NewPDF(), title: title, header: reportHeader(), logos: reportLogos()}
+	rw.newPage()
+	return rw
+}
+
+func (rw *reportWriter) newPage() {
+	p := rw.pdf
+	p.AddPage()
+	top := reportMargin
+	p.Image(rw.logos[0], reportMargin, top, 64, 64)
+	p.Image(rw.logos[1], pdfPageWidth-reportMargin-64, top, 64, 64)
+	lineY := top + 32 - float64(len(rw.header))*9.6/2 + 7
+	for _, line := range rw.header {
+		p.TextAligned(reportMargin+70, lineY, reportWidth-140, 7.5, true, "C", line)
+		lineY += 9.6
+	}
+	titleY := top + 64 + 24
+	p.TextAligned(reportMargin, titleY, reportWidth, 11, true, "C", rw.title)
+	tw := pdfTextWidth(rw.title, 11, true)
+	p.Line(pdfPageWidth/2-tw/2, titleY+2, pdfPageWidth/2+tw/2, titleY+2, 0.8)
+	rw.y = titleY + 16
+	if rw.onNewPage != nil { rw.onNewPage() }
+	rw.top = rw.y
+}
+
+// ensure : Salta de página si no caben h puntos
+func (rw *reportWriter) ensure(h float64) {
+	if rw.y+h > reportBottom { rw.newPage() }
+}
+
+// row : Fila de celdas con borde; alto según el texto más largo. fills indica el gris de fondo (0 sin fondo).
+// Una fila que no cabe en una página completa se reparte entre páginas, repitiendo onNewPage en cada una.
+func (rw *reportWriter) row(widths []float64, cells []reportCell, aligns string, fills []float64, minHeight float64) {
+	wrapped := make([][]reportLine, len(cells))
+	lines := 0
+	for i, cell := range cells {
+		for _, line := range cell {
+			for _, text := range pdfWrap(line.Text, reportFontSize, line.Bold, widths[i]-8) {
+				wrapped[i] = append(wrapped[i], reportLine{text, line.Bold})
+			}
+		}
+		if len(wrapped[i]) > lines { lines = len(wrapped[i]) }
+	}
+	rowHeight := func(n int) float64 {
+		if h := float64(n)*reportLeading + 6; h > minHeight { return h }
+		return minHeight
+	}
+	// Líneas [from, to) de cada celda
+	part := func(from, to int) [][]reportLine {
+		out := make([][]reportLine, len(wrapped))
+		for i, l := range wrapped {
+			if from < len(l) { out[i] = l[from:] }
+			if to-from < len(out[i]) { out[i] = out[i][:to-from] }
+		}
+		return out
+	}
+
+	if height := rowHeight(lines); height <= reportBottom-rw.top {
+		rw.ensure(height)
+		rw.drawRow(widths, wrapped, aligns, fills, height)
+		return
+	}
+	for start := 0; start < lines; {
+		fit := int((reportBottom - rw.y - 6) / reportLeading)
+		if fit < 3 && rw.y > rw.top { rw.newPage(); continue }
+		if fit < 1 { fit = 1 }
+		if start+fit > lines { fit = lines - start }
+		rw.drawRow(widths, part(start, start+fit), aligns, fills, rowHeight(fit))
+		if start += fit; start < lines { rw.newPage() }
+	}
+}
+
+// drawRow : Dibuja una fila ya dividida en líneas, con el texto centrado verticalmente en cada celda
+func (rw *reportWriter) drawRow(widths []float64, wrapped [][]reportLine, aligns string, fills []float64, height float64) {
+	p := rw.pdf
+	x := reportMargin
+	for i, lines := range wrapped {
+		fill := fills != nil && fills[i] > 0
+		if fill { p.SetGray(fills[i]) }
+		p.Rect(x, rw.y, widths[i], height, fill, true)
+		if fill { p.SetGray(0) }
+		align := "L"
+		if i < len(aligns) { align = string(aligns[i]) }
+		ty := rw.y + (height-float64(len(lines))*reportLeading)/2 + reportLeading - 2
+		for _, l := range lines {
+			p.TextAligned(x+4, ty, widths[i]-8, reportFontSize, l.Bold, align, l.Text)
+			ty += reportLeading
+		}
+		x += widths[i]
+	}
+	rw.y += height
+}
+
+// sectionHeader : Barra gris con el título de la sección
+func (rw *reportWriter) sectionHeader(text string) {
+	rw.ensure(40)
+	rw.y += 6
+	rw.row([]float64{reportWidth}, []reportCell{{{text, true}}}, "L", []float64{0.93}, 15)
+}
+
+// infoTable : Pares etiqueta/valor, dos por fila
+func (rw *reportWriter) infoTable(pairs [][2]string) {
+	widths := []float64{reportWidth * 0.15, reportWidth * 0.35, reportWidth * 0.15, reportWidth * 0.35}
+	for i := 0; i < len(pairs); i += 2 {
+		if i+1 == len(pairs) {
+			rw.row([]float64{widths[0], reportWidth - widths[0]}, []reportCell{{{pairs[i][0], true}}, {{pairs[i][1], false}}}, "LL", []float64{0.97, 0}, 15)
+			continue
+		}
+		rw.row(widths, []reportCell{{{pairs[i][0], true}}, {{pairs[i][1], false}}, {{pairs[i+1][0], true}}, {{pairs[i+1][1], false}}},
+			"LLLL", []float64{0.97, 0, 0.97, 0}, 15)
+	}
+}
+
+// signatures : Dos bloques de firma (se mantienen juntos en la misma página)
+func (rw *reportWriter) signatures(signers [2]reportSigner) {
+	rw.ensure(95)
+	p := rw.pdf
+	lineY := rw.y + 60
+	boxW := reportWidth * 0.4
+	for i, s := range signers {
+		x := reportMargin + reportWidth*0.05 + float64(i)*reportWidth*0.5
+		p.Line(x, lineY, x+boxW, lineY, 0.8)
+		p.TextAligned(x, lineY+11, boxW, 8.5, false, "C", s.Name)
+		p.TextAligned(x, lineY+21, boxW, 8.5, true, "C", s.Position)
+		p.TextAligned(x, lineY+30, boxW, 7, false, "C", "FIRMA Y SELLO")
+	}
+	rw.y = lineY + 34
+}
+
+// finish : Pie de página en todas las páginas (la numeración se conoce al final) y escritura del PDF
+func (rw *reportWriter) finish(w http.ResponseWriter, filename, leftFooter string, rightFooter func(page, total int) string) {
+	p := rw.pdf
+	total := p.PageCount()
+	for i := 0; i < total; i++ {
+		p.SetPage(i)
+		y := pdfPageHeight - reportMargin
+		p.SetGray(0.6)
+		p.Rect(reportMargin, y-12, reportWidth, 0.5, true, false)
+		p.SetGray(0.4)
+		p.Text(reportMargin, y, 7.5, false, leftFooter)
+		p.TextAligned(reportMargin, y, reportWidth, 7.5, false, "R", rightFooter(i+1, total))
+		p.SetGray(0)
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="`+filename+`"`)
+	if err := p.Output(w); err != nil { log.Printf("Error generando PDF: %v", err) }
+}
+
+// displayDate : AAAA-MM-DD -> DD/MM/AAAA
+func displayDate(iso string) string {
+	if t, err := time.Parse("2006-01-02", iso); err == nil { return t.Format("02/01/2006") }
+	return iso
+}
+
+// longSpanishDate : "jueves, 16 de octubre de 2026"
+func longSpanishDate(t time.Time) string {
+	days := []string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"}
+	months := []string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"}
+	return fmt.Sprintf("%s, %d de %s de %d", days[t.Weekday()], t.Day(), months[t.Month()-1], t.Year())
+}
+
+func ticketStatusLabel(status string) string {
+	switch status {
+	case "repaired":
+		return "REPARADO"
+	case "unrepaired":
+		return "NO REPARADO"
+	}
+	return "PENDIENTE"
+}
+
+func orDash(s *string) string {
+	if s == nil || strings.TrimSpace(*s) == "" { return "-/-" }
+	return *s
+}
+
+// handleTicketsReportPDF : Reporte de gestión con los filtros del historial (por defecto ?status=history)
+func handleTicketsReportPDF(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("status") == "" {
+		q.Set("status", "history")
+		r.URL.RawQuery = q.Encode()
+	}
+	where, args := ticketListFilter(r)
+	rows, err := db.Query(ticketSelectSQL+where+" ORDER BY t.date_in DESC", args...)
+	if err != nil { handleDbError(w, err); return }
+	defer rows.Close()
+	tickets := []Ticket{}
+	for rows.Next() {
+		t, err := scanTicket(rows)
+		if err != nil { continue }
+		tickets = append(tickets, t)
+	}
+	if len(tickets) == 0 { respondError(w, 404, "No hay datos para generar el reporte."); return }
+
+	rw := newReportWriter("REPORTE DE GESTIÓN DE SOPORTE TÉCNICO")
+	widths := []float64{}
+	for _, f := range []float64{0.05, 0.10, 0.10, 0.20, 0.15, 0.30, 0.10} { widths = append(widths, reportWidth*f) }
+	header := func() {
+		cells := []reportCell{}
+		for _, h := range []string{"N°", "INGRESO", "SALIDA", "EQUIPO", "UBICACIÓN", "DETALLE / SOLUCIÓN", "ESTADO"} {
+			cells = append(cells, reportCell{{h, true}})
+		}
+		rw.row(widths, cells, "CCCCCCC", []float64{0.94, 0.94, 0.94, 0.94, 0.94, 0.94, 0.94}, 16)
+	}
+	header()
+	rw.onNewPage = header
+
+	for i, t := range tickets {
+		dateOut := "-"
+		if t.DateOut != nil { dateOut = displayDate(*t.DateOut) }
+		device := reportCell{{t.DeviceType, true}, {orDash(t.DeviceBrand) + " " + orDash(t.DeviceModel), false}}
+		codeSerial := []string{}
+		if t.DeviceCode != nil && *t.DeviceCode != "" { codeSerial = append(codeSerial, *t.DeviceCode) }
+		if t.DeviceSerial != nil && *t.DeviceSerial != "" { codeSerial = append(codeSerial, *t.DeviceSerial) }
+		if len(codeSerial) > 0 { device = append(device, reportLine{strings.Join(codeSerial, " - "), false}) }
+		location := reportCell{{t.Area, true}}
+		if t.Room != nil { location = append(location, reportLine{*t.Room, false}) }
+		detail := t.DetailsIn
+		if t.DetailsOut != nil && *t.DetailsOut != "" { detail = *t.DetailsOut }
+		if detail == "" { detail = "-" }
+
+		rw.row(widths, []reportCell{
+			{{strconv.Itoa(i + 1), false}}, {{displayDate(t.DateIn), false}}, {{dateOut, false}},
+			device, location, {{detail, false}}, {{ticketStatusLabel(t.Status), false}},
+		}, "CCCCCLC", nil, 18)
+	}
+	rw.onNewPage = nil
+	rw.signatures(reportSigners())
+	rw.finish(w, "reporte_tickets_"+time.Now().Format("2006-01-02")+".pdf", "Sistema S.A.R.T. - "+getSetting("institution_name"), func(page, total int) string {
+		return fmt.Sprintf("Página %d de %d", page, total)
+	})
+}
+
+// handleTicketSubroutes : Rutas bajo /api/tickets/{id}/... (hoy solo receipt.pdf)
+func handleTicketSubroutes(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tickets/"), "/"), "/")
+	if len(parts) == 2 && parts[1] == "receipt.pdf" {
+		if id, err := strconv.Atoi(parts[0]); err == nil {
+			handleTicketReceiptPDF(w, r, id)
+			return
+		}
+	}
+	respondError(w, 404, "Ruta no encontrada")
+}
+
+// handleTicketReceiptPDF : Comprobante de servicio técnico de un ticket, con su bitácora
+func handleTicketReceiptPDF(w http.ResponseWriter, r *http.Request, id int) {
+	t, err := scanTicket(db.QueryRow(ticketSelectSQL+" WHERE t.id = ? AND t.deleted_at IS NULL", id))
+	if err == sql.ErrNoRows { respondError(w, 404, "Ticket no encontrado"); return }
+	if err != nil { handleDbError(w, err); return }
+
+	notes := []TicketNote{}
+	rows, err := db.Query(`SELECT n.id, n.id_ticket, n.id_user, u.full_name, n.created_at, n.note
+		FROM Taller_Nota n LEFT JOIN Usuario u ON n.id_user = u.id
+		WHERE n.id_ticket = ? ORDER BY n.id ASC`, id)
+	if err != nil { handleDbError(w, err); return }
+	for rows.Next() {
+		var n TicketNote
+		if err := rows.Scan(&n.ID, &n.TicketID, &n.UserID, &n.Author, &n.CreatedAt, &n.Note); err != nil { continue }
+		notes = append(notes, n)
+	}
+	rows.Close()
+
+	rw := newReportWriter("COMPROBANTE DE SERVICIO TÉCNICO")
+	rw.pdf.TextAligned(reportMargin, rw.y, reportWidth, 8, false, "R", "Fecha de Impresión: "+longSpanishDate(time.Now()))
+	rw.y += 8
+
+	rw.sectionHeader("1. Datos del Equipo")
+	rw.infoTable([][2]string{
+		{"Tipo:", t.DeviceType}, {"Marca:", orDash(t.DeviceBrand)},
+		{"Modelo:", orDash(t.DeviceModel)}, {"Código Bien:", orDash(t.DeviceCode)},
+		{"Serial:", orDash(t.DeviceSerial)}, {"Procesador:", orDash(t.DeviceCPU)},
+		{"RAM:", orDash(t.DeviceRAM)}, {"Almacenamiento:", orDash(t.DeviceStorage)},
+	})
+
+	rw.sectionHeader("2. Ubicación de Origen")
+	rw.infoTable([][2]string{
+		{"Edificio:", orDash(&t.Building)}, {"Piso:", orDash(&t.Floor)},
+		{"Área:", orDash(&t.Area)}, {"Departamento:", orDash(t.Room)},
+	})
+
+	dateOut := "PENDIENTE"
+	if t.DateOut != nil { dateOut = displayDate(*t.DateOut) }
+	status := ticketStatusLabel(t.Status)
+	if t.Status == "pending" { status = "EN TALLER" }
+	rw.sectionHeader("3. Detalles del Servicio")
+	rw.infoTable([][2]string{
+		{"Fecha Ingreso:", displayDate(t.DateIn)}, {"Fecha Salida:", dateOut},
+		{"Recibido por:", orDash(t.ReceivedName)}, {"Técnico:", orDash(t.AssignedName)},
+		{"Estado Final:", status},
+	})
+
+	detailsIn := t.DetailsIn
+	if detailsIn == "" { detailsIn = "Sin detalles registrados." }
+	rw.sectionHeader("4. Motivo de Ingreso / Falla Reportada")
+	rw.row([]float64{reportWidth}, []reportCell{{{detailsIn, false}}}, "L", nil, 40)
+
+	detailsOut := "Sin informe de salida."
+	if t.DetailsOut != nil && *t.DetailsOut != "" { detailsOut = *t.DetailsOut }
+	rw.sectionHeader("5. Informe Técnico de Salida / Solución")
+	rw.row([]float64{reportWidth}, []reportCell{{{detailsOut, false}}}, "L", nil, 80)
+
+	if len(notes) > 0 {
+		rw.sectionHeader("6. Bitácora de Trabajo")
+		widths := []float64{reportWidth * 0.25, reportWidth * 0.75}
+		for _, n := range notes {
+			who := reportCell{{n.CreatedAt, true}}
+			if n.Author != nil { who = append(who, reportLine{*n.Author, false}) }
+			rw.row(widths, []reportCell{who, {{n.Note, false}}}, "LL", []float64{0.97, 0}, 15)
+		}
+	}
+
+	rw.y += 10
+	rw.signatures(reportSigners())
+	rw.finish(w, fmt.Sprintf("comprobante_ticket_%d.pdf", t.ID), "Sistema S.A.R.T. - Comprobante Digital - "+getSetting("institution_name"), func(page, total int) string {
+		if total > 1 { return fmt.Sprintf("Ticket #%d - Página %d de %d", t.ID, page, total) }
+		return fmt.Sprintf("Ticket #%d", t.ID)
+	})
+}
+
+// nullIfEmpty : Guarda NULL en vez de texto vacío para campos opcionales
+func nullIfEmpty(s string) interface{} {
+	s = strings.TrimSpace(s)
+	if s == "" { return nil }
+	return s
+}
+
+// --- HANDLERS PERÍODOS ---
+
+// handlePeriodsCRUD : Períodos académicos. PUT y DELETE identifican el período con ?code=
+func handlePeriodsCRUD(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		rows, err := db.Query("SELECT code, date_ini, date_end, is_current FROM Periodo ORDER BY date_ini DESC")
+		if err != nil { handleDbError(w, err); return }
+		defer rows.Close()
+
+		periods := []Period{}
+		for rows.Next() {
+			var p Period
+			if err := rows.Scan(&p.Code, &p.DateIni, &p.DateEnd, &p.IsCurrent); err != nil { continue }
+			periods = append(periods, p)
+		}
+		respondJSON(w, map[string]interface{}{"data": periods})
+
+	} else if r.Method == "POST" || r.Method == "PUT" {
+		var p Period
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil { respondError(w, 400, "JSON inválido"); return }
+		p.Code = strings.TrimSpace(p.Code)
+		oldCode := r.URL.Query().Get("code")
+		if r.Method == "PUT" && oldCode == "" { respondError(w, 400, "Código requerido"); return }
+		if p.Code == "" { respondError(w, 400, "El código del período es obligatorio"); return }
+		if msg := validatePeriodRange(p, oldCode); msg != "" { respondError(w, 409, msg); return }
+
+		tx, err := db.Begin()
+		if err != nil { handleDbError(w, err); return }
+		defer tx.Rollback()
+
+		var before map[string]interface{}
+		if r.Method == "POST" {
+			_, err = tx.Exec("INSERT INTO Periodo (code, date_ini, date_end, is_current) VALUES (?, ?, ?, 0)", p.Code, p.DateIni, p.DateEnd)
+		} else {
+			before = snapshotRowBy("Periodo", "code", oldCode)
+			if before == nil { respondError(w, 404, "Período no encontrado"); return }
+			_, err = tx.Exec("UPDATE Periodo SET code = ?, date_ini = ?, date_end = ? WHERE code = ?", p.Code, p.DateIni, p.DateEnd, oldCode)
+		}
+		if err != nil { handleDbError(w, err); return }
+		if p.IsCurrent {
+			if err := setCurrentPeriod(tx, p.Code); err != nil { handleDbError(w, err); return }
+		}
+		if err := tx.Commit(); err != nil { handleDbError(w, err); return }
+
+		action := "create"
+		if r.Method == "PUT" { action = "update" }
+		recordAudit(r, "Periodo", p.Code, action, before, snapshotRowBy("Periodo", "code", p.Code))
+		respondJSON(w, map[string]bool{"success": true})
+
+	} else if r.Method == "DELETE" {
+		code := r.URL.Query().Get("code")
+		if code == "" { respondError(w, 400, "Código requerido"); return }
+		before := snapshotRowBy("Periodo", "code", code)
+		if before == nil { respondError(w, 404, "Período no encontrado"); return }
+		if cur, _ := before["is_current"].(int64); cur == 1 {
+			respondError(w, 409, "No se puede eliminar el período actual. Marque otro período como actual primero.")
+			return
+		}
+		_, err := db.Exec("DELETE FROM Periodo WHERE code = ?", code)
+		if err != nil { handleDbError(w, err); return }
+		recordAudit(r, "Periodo", code, "delete", before, nil)
+		respondJSON(w, map[string]bool{"success": true})
+	}
+}
+
+// handleCurrentPeriod : GET devuelve el período actual, POST ?code= lo cambia
+func handleCurrentPeriod(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		p, err := currentPeriod()
+		if err == sql.ErrNoRows { respondError(w, 404, "No hay un período académico configurado"); return }
+		if err != nil { handleDbError(w, err); return }
+		respondJSON(w, p)
+
+	} else if r.Method == "POST" {
+		code := r.URL.Query().Get("code")
+		if code == "" { respondError(w, 400, "Código requerido"); return }
+		before := snapshotRowBy("Periodo", "code", code)
+		if before == nil { respondError(w, 404, "Período no encontrado"); return }
+
+		tx, err := db.Begin()
+		if err != nil { handleDbError(w, err); return }
+		defer tx.Rollback()
+		if err := setCurrentPeriod(tx, code); err != nil { handleDbError(w, err); return }
+		if err := tx.Commit(); err != nil { handleDbError(w, err); return }
+
+		recordAudit(r, "Periodo", code, "set_current", before, snapshotRowBy("Periodo", "code", code))
+		respondJSON(w, map[string]bool{"success": true})
+	}
+}
+
+// setCurrentPeriod : Deja un único período marcado como actual dentro de la transacción
+func setCurrentPeriod(tx *sql.Tx, code string) error {
+	if _, err := tx.Exec("UPDATE Periodo SET is_current = 0 WHERE is_current = 1 AND code != ?", code); err != nil { return err }
+	_, err := tx.Exec("UPDATE Periodo SET is_current = 1 WHERE code = ?", code)
+	return err
+}
+
+// currentPeriod : Período marcado como actual. Si ninguno lo está, el que contiene la fecha de hoy
+// y en su defecto el último que terminó ("Sticky Period": tras el cierre se sigue mostrando).
+func currentPeriod() (Period, error) {
+	var p Period
+	today := time.Now().Format("2006-01-02")
+	err := db.QueryRow(`SELECT code, date_ini, date_end, is_current FROM Periodo 
+		ORDER BY is_current DESC, (date_ini <= ? AND date_end >= ?) DESC, (date_ini <= ?) DESC, date_ini DESC LIMIT 1`,
+		today, today, today).Scan(&p.Code, &p.DateIni, &p.DateEnd, &p.IsCurrent)
+	return p, err
+}
+
+// validatePeriodRange : Fechas ISO, inicio antes del fin y sin solapamiento con otros períodos
+func validatePeriodRange(p Period, ignoreCode string) string {
+	ini, errIni := time.Parse("2006-01-02", p.DateIni)
+	end, errEnd := time.Parse("2006-01-02", p.DateEnd)
+	if errIni != nil || errEnd != nil { return "Las fechas deben tener el formato AAAA-MM-DD." }
+	if !ini.Before(end) { return "La fecha de inicio debe ser anterior a la fecha de fin." }
+
+	var other string
+	err := db.QueryRow("SELECT code FROM Periodo WHERE date_ini <= ? AND date_end >= ? AND code != ? LIMIT 1",
+		p.DateEnd, p.DateIni, ignoreCode).Scan(&other)
+	if err == nil { return fmt.Sprintf("El rango de fechas se solapa con el período %s.", other) }
+	return ""
+}
+
+// --- PAPELERA ---
+
+// softDelete : Envía el registro a la papelera en lugar de borrarlo
+func softDelete(table string, id interface{}) error {
+	_, err := db.Exec(fmt.Sprintf("UPDATE %s SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL", table), time.Now().Format(TIMESTAMP_LAYOUT), id)
+	return err
+}
+
+// handleTrash : GET lista lo eliminado (?table= opcional), DELETE purga definitivamente (?table=&id=)
+func handleTrash(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
 		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
@@ -1531,107 +4476,209 @@ func handleTicketsCRUD(w http.ResponseWriter, r *http.Request) {
 		if limit < 1 { limit = 10 }
 		offset := (page - 1) * limit
 
-		where := " WHERE 1=1 "
-		args := []interface{}{}
-
-		status := r.URL.Query().Get("status")
-		if status == "history" {
-			where += " AND t.status IN ('repaired', 'unrepaired') "
-		} else if status != "" && status != "all" {
-			where += " AND t.status = ? "
-			args = append(args, status)
+		keys := trashTableOrder
+		if key := r.URL.Query().Get("table"); key != "" {
+			if _, ok := trashTables[key]; !ok { respondError(w, 400, "Tabla inválida"); return }
+			keys = []string{key}
 		}
-
-		if val := r.URL.Query().Get("after"); val != "" {
-			where += " AND t.date_out >= ? "
-			args = append(args, val)
-		}
-		if val := r.URL.Query().Get("before"); val != "" {
-			where += " AND t.date_out <= ? "
-			args = append(args, val)
+		parts := []string{}
+		for _, key := range keys {
+			t := trashTables[key]
+			parts = append(parts, fmt.Sprintf("SELECT '%s' AS tbl, x.id AS id, COALESCE(%s, '') AS value, x.deleted_at AS deleted_at FROM %s x WHERE x.deleted_at IS NOT NULL", key, t.Label, t.Table))
 		}
+		union := strings.Join(parts, " UNION ALL ")
 
 		search := r.URL.Query().Get("search")
-		if search != "" {
-			term := "%" + search + "%"
-			where += ` AND (
-				v.code LIKE ? OR v.serial LIKE ? OR v.brand LIKE ? OR v.model LIKE ? OR 
-				v.building LIKE ? OR v.area LIKE ? OR 
-				t.details_in LIKE ? OR t.details_out LIKE ?
-			) `
-			for i := 0; i < 8; i++ { args = append(args, term) }
-		}
-		
-		if val := r.URL.Query().Get("type"); val != "" { where += " AND v.id_type = ? "; args = append(args, val) }
-		if val := r.URL.Query().Get("brand"); val != "" { where += " AND v.id_brand = ? "; args = append(args, val) }
+		where := " WHERE 1=1 "
+		args := []interface{}{}
+		if search != "" { where += " AND value LIKE ? "; args = append(args, "%"+search+"%") }
 
 		var total int
-		db.QueryRow("SELECT COUNT(*) FROM Taller t JOIN Vista_Datos_Dispositivo_Completo v ON t.id_device=v.device_id "+where, args...).Scan(&total)
+		db.QueryRow("SELECT COUNT(*) FROM ("+union+") "+where, args...).Scan(&total)
 
-		query := `
-			SELECT t.id, t.id_device, t.date_in, t.details_in, t.status, t.date_out, t.details_out,
-			       v.code, v.serial, v.brand, v.model, v.device_type,
-				   v.building, v.floor, v.area, v.room,
-				   v.os, v.ram, v.storage, v.processor, v.arch
-			FROM Taller t
-			JOIN Vista_Datos_Dispositivo_Completo v ON t.id_device = v.device_id
-			` + where + ` ORDER BY t.date_in DESC LIMIT ? OFFSET ?`
-		
 		args = append(args, limit, offset)
-		rows, _ := db.Query(query, args...)
+		rows, err := db.Query("SELECT tbl, id, value, deleted_at FROM ("+union+") "+where+" ORDER BY deleted_at DESC LIMIT ? OFFSET ?", args...)
+		if err != nil {
+			log.Printf("Query Error: %v", err)
+			respondError(w, 500, "Error DB")
+			return
+		}
 		defer rows.Close()
 
-		tickets := []Ticket{}
+		items := []TrashItem{}
 		for rows.Next() {
-			var t Ticket
-			var dOut, detOut sql.NullString
-			rows.Scan(&t.ID, &t.DeviceID, &t.DateIn, &t.DetailsIn, &t.Status, &dOut, &detOut,
-				&t.DeviceCode, &t.DeviceSerial, &t.DeviceBrand, &t.DeviceModel, &t.DeviceType,
-				&t.Building, &t.Floor, &t.Area, &t.Room,
-				&t.DeviceOS, &t.DeviceRAM, &t.DeviceStorage, &t.DeviceCPU, &t.DeviceArch)
-			
-			if dOut.Valid { t.DateOut = &dOut.String }
-			if detOut.Valid { t.DetailsOut = &detOut.String }
-			tickets = append(tickets, t)
+			var i TrashItem
+			if err := rows.Scan(&i.Table, &i.ID, &i.Value, &i.DeletedAt); err != nil { continue }
+			items = append(items, i)
 		}
-		respondJSON(w, TicketResponse{Data: tickets, Total: total, Page: page, Limit: limit})
+		respondJSON(w, TrashResponse{Data: items, Total: total, Page: page, Limit: limit})
 
-	} else if r.Method == "POST" {
-		var t Ticket
-		json.NewDecoder(r.Body).Decode(&t)
-		db.Exec("INSERT INTO Taller (id_device, date_in, details_in, status) VALUES (?, ?, ?, 'pending')", t.DeviceID, t.DateIn, t.DetailsIn)
-		respondJSON(w, map[string]interface{}{"success": true})
-	} else if r.Method == "PUT" {
-		id := r.URL.Query().Get("id")
-		var t map[string]interface{}
-		json.NewDecoder(r.Body).Decode(&t)
-		
-		if dateOut, ok := t["date_out"]; ok && dateOut != "" {
-			if status, ok := t["status"]; ok && status == "pending" {
-				respondError(w, 400, "No se puede cerrar un ticket con estado 'pending'.")
+	} else if r.Method == "DELETE" {
+		t, id, ok := trashTarget(w, r)
+		if !ok { return }
+		for _, rel := range trashRelations {
+			if rel.Parent != t.Table { continue }
+			var count int
+			db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s = ?", rel.Child, rel.Column), id).Scan(&count)
+			if count > 0 {
+				respondError(w, 409, "No se puede purgar: existen registros que dependen de este (aunque estén en la papelera).")
 				return
 			}
 		}
-		
-		if t["status"] != nil {
-			db.Exec("UPDATE Taller SET status=?, date_out=?, details_out=? WHERE id=?", t["status"], t["date_out"], t["details_out"], id)
-		} else {
-			db.Exec("UPDATE Taller SET date_in=?, details_in=? WHERE id=?", t["date_in"], t["details_in"], id)
+
+		before := snapshotRow(t.Table, id)
+		for _, owned := range trashOwned[t.Table] {
+			db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", owned.Table, owned.Column), id)
 		}
-		respondJSON(w, map[string]bool{"success": true})
-	} else if r.Method == "DELETE" {
-		id := r.URL.Query().Get("id")
-		if id == "" { respondError(w, 400, "ID requerido"); return }
-		_, err := db.Exec("DELETE FROM Taller WHERE id = ?", id)
+		_, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = ? AND deleted_at IS NOT NULL", t.Table), id)
 		if err != nil { handleDbError(w, err); return }
+		recordAudit(r, t.Table, id, "purge", before, nil)
 		respondJSON(w, map[string]bool{"success": true})
 	}
 }
 
+// handleTrashRestore : Devuelve un registro de la papelera si sus referencias siguen activas
+func handleTrashRestore(w http.ResponseWriter, r *http.Request) {
+	t, id, ok := trashTarget(w, r)
+	if !ok { return }
+	for _, rel := range trashRelations {
+		if rel.Child != t.Table { continue }
+		var count int
+		db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = (SELECT %s FROM %s WHERE id = ?) AND deleted_at IS NOT NULL",
+			rel.Parent, rel.Column, rel.Child), id).Scan(&count)
+		if count > 0 {
+			respondError(w, 409, fmt.Sprintf("No se puede restaurar: primero restaure el registro relacionado en %s.", rel.Parent))
+			return
+		}
+	}
+
+	if t.Table == "Taller" {
+		var deviceID int
+		var status string
+		db.QueryRow("SELECT id_device, status FROM Taller WHERE id = ?", id).Scan(&deviceID, &status)
+		ticketID, _ := strconv.Atoi(id)
+		if status == "pending" && respondOpenTicketConflict(w, deviceID, ticketID) { return }
+	}
+
+	_, err := db.Exec(fmt.Sprintf("UPDATE %s SET deleted_at = NULL WHERE id = ?", t.Table), id)
+	if err != nil { handleDbError(w, err); return }
+	recordAudit(r, t.Table, id, "restore", nil, snapshotRow(t.Table, id))
+	respondJSON(w, map[string]bool{"success": true})
+}
+
+// trashTarget : Valida ?table=&id= y que el registro esté efectivamente en la papelera
+func trashTarget(w http.ResponseWriter, r *http.Request) (TrashTable, string, bool) {
+	t, ok := trashTables[r.URL.Query().Get("table")]
+	if !ok { respondError(w, 400, "Tabla inválida"); return t, "", false }
+	id := r.URL.Query().Get("id")
+	if id == "" { respondError(w, 400, "ID requerido"); return t, "", false }
+
+	var count int
+	db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = ? AND deleted_at IS NOT NULL", t.Table), id).Scan(&count)
+	if count == 0 { respondError(w, 404, "El registro no está en la papelera"); return t, "", false }
+	return t, id, true
+}
+
+// --- AUDITORÍA ---
+
+// handleAudit : Consulta de solo lectura con filtros y paginación
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if page < 1 { page = 1 }
+	if limit < 1 { limit = 20 }
+	offset := (page - 1) * limit
+
+	where := " WHERE 1=1 "
+	args := []interface{}{}
+	if val := r.URL.Query().Get("entity"); val != "" { where += " AND entity = ? "; args = append(args, val) }
+	if val := r.URL.Query().Get("entity_id"); val != "" { where += " AND entity_id = ? "; args = append(args, val) }
+	if val := r.URL.Query().Get("id_user"); val != "" { where += " AND id_user = ? "; args = append(args, val) }
+	if val := r.URL.Query().Get("action"); val != "" { where += " AND action = ? "; args = append(args, val) }
+	if val := r.URL.Query().Get("after"); val != "" { where += " AND created_at >= ? "; args = append(args, val) }
+	if val := r.URL.Query().Get("before"); val != "" { where += " AND created_at < date(?, '+1 day') "; args = append(args, val) }
+
+	var total int
+	db.QueryRow("SELECT COUNT(*) FROM Auditoria "+where, args...).Scan(&total)
+
+	args = append(args, limit, offset)
+	rows, err := db.Query(`SELECT id, id_user, username, created_at, entity, entity_id, action, before_data, after_data 
+		FROM Auditoria `+where+` ORDER BY id DESC LIMIT ? OFFSET ?`, args...)
+	if err != nil {
+		log.Printf("Query Error: %v", err)
+		respondError(w, 500, "Error DB")
+		return
+	}
+	defer rows.Close()
+
+	items := []AuditEntry{}
+	for rows.Next() {
+		var a AuditEntry
+		var before, after sql.NullString
+		if err := rows.Scan(&a.ID, &a.UserID, &a.Username, &a.CreatedAt, &a.Entity, &a.EntityID, &a.Action, &before, &after); err != nil { continue }
+		if b, ok := a.EntityID.([]byte); ok { a.EntityID = string(b) }
+		if before.Valid { a.Before = json.RawMessage(before.String) }
+		if after.Valid { a.After = json.RawMessage(after.String) }
+		items = append(items, a)
+	}
+	respondJSON(w, AuditResponse{Data: items, Total: total, Page: page, Limit: limit})
+}
+
+// recordAudit : Registra quién hizo qué sobre una entidad. Un fallo aquí no interrumpe la operación.
+func recordAudit(r *http.Request, entity string, entityID interface{}, action string, before, after map[string]interface{}) {
+	var userID, username interface{}
+	if su := currentUser(r); su != nil {
+		userID, username = su.ID, su.Username
+	}
+	_, err := db.Exec(`INSERT INTO Auditoria (id_user, username, created_at, entity, entity_id, action, before_data, after_data) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, username, time.Now().Format(TIMESTAMP_LAYOUT), entity, entityID, action, auditJSON(before), auditJSON(after))
+	if err != nil {
+		log.Printf("Error registrando auditoría (%s %s %v): %v", action, entity, entityID, err)
+	}
+}
+
+func auditJSON(row map[string]interface{}) interface{} {
+	if row == nil { return nil }
+	b, err := json.Marshal(row)
+	if err != nil { return nil }
+	return string(b)
+}
+
+// snapshotRow : Fila completa (columna -> valor) para la auditoría, sin contraseñas
+func snapshotRow(table string, id interface{}) map[string]interface{} {
+	return snapshotRowBy(table, "id", id)
+}
+
+// snapshotRowBy : Igual que snapshotRow, para tablas cuya clave no es "id" (ej. Periodo.code)
+func snapshotRowBy(table, keyColumn string, key interface{}) map[string]interface{} {
+	rows, err := db.Query(fmt.Sprintf("SELECT * FROM %s WHERE %s = ?", table, keyColumn), key)
+	if err != nil { return nil }
+	defer rows.Close()
+	if !rows.Next() { return nil }
+
+	cols, _ := rows.Columns()
+	vals := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals { ptrs[i] = &vals[i] }
+	if err := rows.Scan(ptrs...); err != nil { return nil }
+
+	row := map[string]interface{}{}
+	for i, col := range cols {
+		if col == "password" { continue }
+		if b, ok := vals[i].([]byte); ok {
+			row[col] = string(b)
+		} else {
+			row[col] = vals[i]
+		}
+	}
+	return row
+}
+
 // --- HELPERS ---
 
 func getSelectItems(table, field string) []SelectItem {
-	rows, _ := db.Query(fmt.Sprintf("SELECT id, %s FROM %s ORDER BY %s ASC", field, table, field))
+	rows, _ := db.Query(fmt.Sprintf("SELECT id, %s FROM %s WHERE deleted_at IS NULL ORDER BY %s ASC", field, table, field))
 	defer rows.Close()
 	items := []SelectItem{}
 	for rows.Next() {
@@ -1643,7 +4690,7 @@ func getSelectItems(table, field string) []SelectItem {
 }
 
 func getSelectItemsWithParent(table, field, parentField string) []SelectItem {
-	rows, _ := db.Query(fmt.Sprintf("SELECT id, %s, %s FROM %s ORDER BY %s ASC", field, parentField, table, field))
+	rows, _ := db.Query(fmt.Sprintf("SELECT id, %s, %s FROM %s WHERE deleted_at IS NULL ORDER BY %s ASC", field, parentField, table, field))
 	defer rows.Close()
 	items := []SelectItem{}
 	for rows.Next() {
@@ -1655,7 +4702,7 @@ func getSelectItemsWithParent(table, field, parentField string) []SelectItem {
 }
 
 func getModels() []SelectItem {
-	rows, _ := db.Query("SELECT id, model, id_brand FROM Modelo ORDER BY model ASC")
+	rows, _ := db.Query("SELECT id, model, id_brand FROM Modelo WHERE deleted_at IS NULL ORDER BY model ASC")
 	defer rows.Close()
 	items := []SelectItem{}
 	for rows.Next() {
@@ -1666,8 +4713,325 @@ func getModels() []SelectItem {
 	return items
 }
 
+// --- CONTRASEÑAS ---
+
+// pbkdf2SHA256 : PBKDF2 (RFC 8018) con HMAC-SHA256, sin dependencias externas
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	dk := make([]byte, 0, numBlocks*hashLen)
+	buf := make([]byte, 4)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		buf[0], buf[1], buf[2], buf[3] = byte(block>>24), byte(block>>16), byte(block>>8), byte(block)
+		prf.Write(buf)
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+// hashPassword : Formato "pbkdf2_sha256$iteraciones$salt$hash" (base64)
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, PASSWORD_ITERATIONS, 32)
+	return fmt.Sprintf("%s$%d$%s$%s", PASSWORD_SCHEME, PASSWORD_ITERATIONS,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, PASSWORD_SCHEME+"$")
+}
+
+func verifyPassword(stored, password string) bool {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 4 || parts[0] != PASSWORD_SCHEME { return false }
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter < 1 { return false }
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil { return false }
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil { return false }
+	return subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(password), salt, iter, len(key)), key) == 1
+}
+
+func loadPasswordPolicy() {
+	if v, err := strconv.Atoi(os.Getenv("SART_PASSWORD_MIN_LENGTH")); err == nil && v > 0 {
+		passwordPolicy.MinLength = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("SART_PASSWORD_MIN_CLASSES")); err == nil && v >= 0 && v <= 4 {
+		passwordPolicy.MinClasses = v
+	}
+	log.Printf("Política de contraseñas: mínimo %d caracteres, %d tipos de caracter", passwordPolicy.MinLength, passwordPolicy.MinClasses)
+}
+
+// validatePasswordPolicy : Devuelve un error con mensaje para el usuario si no cumple la política
+func validatePasswordPolicy(password string) error {
+	if utf8.RuneCountInString(password) < passwordPolicy.MinLength {
+		return fmt.Errorf("La contraseña debe tener al menos %d caracteres.", passwordPolicy.MinLength)
+	}
+	var lower, upper, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		case !unicode.IsSpace(c):
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, ok := range []bool{lower, upper, digit, symbol} {
+		if ok { classes++ }
+	}
+	if classes < passwordPolicy.MinClasses {
+		return fmt.Errorf("La contraseña debe combinar al menos %d de: minúsculas, mayúsculas, números y símbolos.", passwordPolicy.MinClasses)
+	}
+	return nil
+}
+
+// flagDefaultPasswords : Marca para cambio obligatorio las cuentas que conservan la contraseña semilla
+func flagDefaultPasswords() {
+	rows, err := db.Query("SELECT id, password FROM Usuario")
+	if err != nil { return }
+	flagged := []int{}
+	for rows.Next() {
+		var id int
+		var stored string
+		if err := rows.Scan(&id, &stored); err != nil { continue }
+		if verifyPassword(stored, DEFAULT_PASSWORD) { flagged = append(flagged, id) }
+	}
+	rows.Close()
+
+	for _, id := range flagged {
+		db.Exec("UPDATE Usuario SET must_change_password = 1 WHERE id = ?", id)
+		log.Printf("Usuario %d usa la contraseña por defecto: cambio obligatorio", id)
+	}
+}
+
+// migratePlaintextPasswords : Convierte al arranque las contraseñas heredadas en texto plano
+func migratePlaintextPasswords() {
+	rows, err := db.Query("SELECT id, password FROM Usuario")
+	if err != nil {
+		log.Printf("Error leyendo usuarios para migrar contraseñas: %v", err)
+		return
+	}
+	pending := map[int]string{}
+	for rows.Next() {
+		var id int
+		var pass string
+		if err := rows.Scan(&id, &pass); err != nil { continue }
+		if !isPasswordHash(pass) { pending[id] = pass }
+	}
+	rows.Close()
+
+	for id, pass := range pending {
+		hash, err := hashPassword(pass)
+		if err != nil {
+			log.Printf("Error cifrando contraseña del usuario %d: %v", id, err)
+			continue
+		}
+		if _, err := db.Exec("UPDATE Usuario SET password=? WHERE id=?", hash, id); err != nil {
+			log.Printf("Error migrando contraseña del usuario %d: %v", id, err)
+			continue
+		}
+		log.Printf("Contraseña del usuario %d migrada a %s", id, PASSWORD_SCHEME)
+	}
+}
+
+// --- PROTECCIÓN CONTRA FUERZA BRUTA ---
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil { return r.RemoteAddr }
+	return host
+}
+
+// loginBackoff : Espera exigida tras n fallos consecutivos (1s, 2s, 4s... hasta LOGIN_BACKOFF_MAX)
+func loginBackoff(failures int) time.Duration {
+	if failures <= 0 { return 0 }
+	wait := LOGIN_BACKOFF_BASE
+	for i := 1; i < failures && wait < LOGIN_BACKOFF_MAX; i++ {
+		wait *= 2
+	}
+	if wait > LOGIN_BACKOFF_MAX { wait = LOGIN_BACKOFF_MAX }
+	return wait
+}
+
+// loginBlocked : Tiempo restante antes de aceptar otro intento, y si se trata de un bloqueo
+func loginBlocked(t LoginThrottle, subject string) (time.Duration, bool) {
+	loginMu.Lock()
+	defer loginMu.Unlock()
+
+	var failures int
+	var lastFailure, lockedUntil int64
+	err := db.QueryRow("SELECT failures, last_failure, locked_until FROM Intento_Acceso WHERE kind = ? AND subject = ?",
+		t.Kind, subject).Scan(&failures, &lastFailure, &lockedUntil)
+	if err != nil { return 0, false }
+
+	now := time.Now()
+	if until := time.Unix(lockedUntil, 0); until.After(now) {
+		return until.Sub(now), true
+	}
+	if lockedUntil > 0 { return 0, false } // Bloqueo vencido: el siguiente fallo reinicia el conteo
+	if next := time.Unix(lastFailure, 0).Add(loginBackoff(failures)); next.After(now) {
+		return next.Sub(now), false
+	}
+	return 0, false
+}
+
+func registerLoginFailure(t LoginThrottle, subject string) {
+	loginMu.Lock()
+	defer loginMu.Unlock()
+
+	now := time.Now()
+	var failures int
+	var lockedUntil int64
+	db.QueryRow("SELECT failures, locked_until FROM Intento_Acceso WHERE kind = ? AND subject = ?", t.Kind, subject).Scan(&failures, &lockedUntil)
+	if lockedUntil > 0 && lockedUntil <= now.Unix() {
+		failures, lockedUntil = 0, 0
+	}
+	failures++
+	if failures >= t.MaxFailures {
+		lockedUntil = now.Add(t.Lockout).Unix()
+		log.Printf("Bloqueo temporal (%s): %q tras %d intentos fallidos, hasta %s",
+			t.Kind, subject, failures, time.Unix(lockedUntil, 0).Format("2006-01-02 15:04:05"))
+	}
+
+	// Limpieza de registros inactivos
+	db.Exec("DELETE FROM Intento_Acceso WHERE last_failure < ? AND locked_until < ?", now.Add(-24*time.Hour).Unix(), now.Unix())
+	_, err := db.Exec(`INSERT INTO Intento_Acceso (kind, subject, failures, last_failure, locked_until) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(kind, subject) DO UPDATE SET failures = excluded.failures, last_failure = excluded.last_failure, locked_until = excluded.locked_until`,
+		t.Kind, subject, failures, now.Unix(), lockedUntil)
+	if err != nil {
+		log.Printf("Error registrando intento fallido: %v", err)
+	}
+}
+
+func resetLoginFailures(t LoginThrottle, subject string) {
+	loginMu.Lock()
+	defer loginMu.Unlock()
+	db.Exec("DELETE FROM Intento_Acceso WHERE kind = ? AND subject = ?", t.Kind, subject)
+}
+
+func respondThrottled(w http.ResponseWriter, wait time.Duration, locked bool) {
+	secs := int(wait.Seconds() + 0.999)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	if locked {
+		respondError(w, 429, fmt.Sprintf("Acceso bloqueado temporalmente por intentos fallidos. Intente nuevamente en %d minuto(s).", (secs+59)/60))
+	} else {
+		respondError(w, 429, fmt.Sprintf("Demasiados intentos. Espere %d segundo(s) antes de reintentar.", secs))
+	}
+}
+
+// --- SESIONES ---
+
+// createSession : Genera un token aleatorio y lo registra con su fecha de expiración
+func createSession(userID int, scope string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	now := time.Now()
+
+	// Limpieza oportunista de sesiones vencidas
+	db.Exec("DELETE FROM Sesion WHERE expires_at <= ?", now.Unix())
+
+	_, err := db.Exec("INSERT INTO Sesion (token, id_user, scope, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		token, userID, scope, now.Unix(), now.Add(SESSION_TTL).Unix())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// lookupSession : Devuelve el usuario dueño de un token vigente, o nil
+func lookupSession(token string) *SessionUser {
+	if token == "" { return nil }
+	su := SessionUser{Token: token}
+	err := db.QueryRow(`SELECT u.id, u.username, u.rol, COALESCE(s.scope, 'full') FROM Sesion s 
+		JOIN Usuario u ON s.id_user = u.id 
+		WHERE s.token = ? AND s.expires_at > ?`, token, time.Now().Unix()).Scan(&su.ID, &su.Username, &su.Role, &su.Scope)
+	if err != nil { return nil }
+	return &su
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// currentUser : Usuario de la sesión adjuntado al request por middlewareAuth
+func currentUser(r *http.Request) *SessionUser {
+	su, _ := r.Context().Value(ctxSessionUser).(*SessionUser)
+	return su
+}
+
 func middlewareAuth(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) { next(w, r) }
+	return func(w http.ResponseWriter, r *http.Request) {
+		su := lookupSession(bearerToken(r))
+		if su == nil {
+			respondError(w, 401, "Sesión inválida o expirada. Inicie sesión nuevamente.")
+			return
+		}
+		if su.Scope != SCOPE_FULL && !passwordChangeRoutes[r.URL.Path] {
+			respondError(w, 403, "Debe cambiar su contraseña antes de continuar.")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), ctxSessionUser, su)))
+	}
+}
+
+// middlewarePermission : Aplica la tabla de permisos según la ruta registrada y el método
+func middlewarePermission(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed, ok := permissions[route][r.Method]
+		if !ok {
+			respondError(w, 405, "Método no permitido")
+			return
+		}
+		su := currentUser(r)
+		for _, role := range allowed {
+			if su != nil && su.Role == role {
+				next(w, r)
+				return
+			}
+		}
+		if su != nil {
+			log.Printf("Acceso denegado: usuario=%s rol=%s %s %s", su.Username, su.Role, r.Method, r.URL.Path)
+		}
+		respondError(w, 403, "Acceso denegado: su rol no tiene permiso para realizar esta operación.")
+	}
+}
+
+// secure : Autenticación + autorización para una ruta de la API
+func secure(route string, next http.HandlerFunc) http.HandlerFunc {
+	return middlewareAuth(middlewarePermission(route, next))
 }
 
 func respondJSON(w http.ResponseWriter, data interface{}) {
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// --- GENERACIÓN DE PDF (SOLO BIBLIOTECA ESTÁNDAR) ---
+// Usa las fuentes estándar Helvetica y Helvetica-Bold con WinAnsiEncoding: no se incrustan
+// (todo visor PDF las trae) y cubren los acentos del español.
+
+const (
+	pdfPageWidth  = 612.0 // Carta (215.9 x 279.4 mm) en puntos
+	pdfPageHeight = 792.0
+)
+
+// PDF : Documento en construcción. Las coordenadas se expresan desde la esquina superior izquierda.
+type PDF struct {
+	pages    []*bytes.Buffer
+	cur      *bytes.Buffer
+	images   []*pdfImage
+	imageIdx map[*pdfImage]int // Las imágenes se comparten entre documentos: el número es propio de cada PDF
+}
+
+// pdfImage : Imagen lista para incrustar (JPEG tal cual, PNG descomprimido y vuelto a comprimir)
+type pdfImage struct {
+	Width, Height int
+	ColorSpace    string
+	Filter        string
+	Data          []byte
+	Alpha         []byte // Máscara de transparencia (DeviceGray, FlateDecode), opcional
+}
+
+func NewPDF() *PDF { return &PDF{imageIdx: map[*pdfImage]int{}} }
+
+// AddPage : Agrega una página en blanco y la deja como actual
+func (p *PDF) AddPage() {
+	p.cur = &bytes.Buffer{}
+	p.pages = append(p.pages, p.cur)
+}
+
+func (p *PDF) PageCount() int { return len(p.pages) }
+
+// SetPage : Vuelve a una página ya creada (ej. para numerarlas al final)
+func (p *PDF) SetPage(i int) { p.cur = p.pages[i] }
+
+// SetGray : Color de relleno y de texto (0 negro, 1 blanco)
+func (p *PDF) SetGray(g float64) { fmt.Fprintf(p.cur, "%.3f g\n", g) }
+
+// Text : Texto con la línea base en (x, y)
+func (p *PDF) Text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold { font = "F2" }
+	fmt.Fprintf(p.cur, "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, pdfPageHeight-y, pdfEscape(s))
+}
+
+// TextAligned : Texto alineado ("L", "C" o "R") dentro de un ancho
+func (p *PDF) TextAligned(x, y, width, size float64, bold bool, align, s string) {
+	switch align {
+	case "C":
+		x += (width - pdfTextWidth(s, size, bold)) / 2
+	case "R":
+		x += width - pdfTextWidth(s, size, bold)
+	}
+	p.Text(x, y, size, bold, s)
+}
+
+func (p *PDF) Line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(p.cur, "%.2f w %.2f %.2f m %.2f %.2f l S\n", width, x1, pdfPageHeight-y1, x2, pdfPageHeight-y2)
+}
+
+// Rect : Rectángulo con relleno (color actual) y/o borde negro de 0.5 pt
+func (p *PDF) Rect(x, y, w, h float64, fill, stroke bool) {
+	if !fill && !stroke { return }
+	op := "S"
+	if fill && stroke { op = "B" } else if fill { op = "f" }
+	fmt.Fprintf(p.cur, "0.5 w 0 G %.2f %.2f %.2f %.2f re %s\n", x, pdfPageHeight-y-h, w, h, op)
+}
+
+// Image : Dibuja la imagen centrada dentro del recuadro, conservando la proporción
+func (p *PDF) Image(img *pdfImage, x, y, w, h float64) {
+	if img == nil { return }
+	idx, ok := p.imageIdx[img]
+	if !ok {
+		p.images = append(p.images, img)
+		idx = len(p.images)
+		p.imageIdx[img] = idx
+	}
+	scale := w / float64(img.Width)
+	if s := h / float64(img.Height); s < scale { scale = s }
+	dw, dh := float64(img.Width)*scale, float64(img.Height)*scale
+	x += (w - dw) / 2
+	y += (h - dh) / 2
+	fmt.Fprintf(p.cur, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", dw, dh, x, pdfPageHeight-y-dh, idx)
+}
+
+// Output : Escribe el documento completo
+func (p *PDF) Output(w io.Writer) error {
+	if len(p.pages) == 0 { p.AddPage() }
+	var buf bytes.Buffer
+	offsets := []int{}
+	obj := func(body string, stream []byte) int {
+		offsets = append(offsets, buf.Len())
+		n := len(offsets)
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\n", n, body)
+		if stream != nil {
+			buf.WriteString("stream\n")
+			buf.Write(stream)
+			buf.WriteString("\nendstream\n")
+		}
+		buf.WriteString("endobj\n")
+		return n
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	// 1: catálogo, 2: árbol de páginas (se escribe al final con los hijos), 3 y 4: fuentes
+	offsets = append(offsets, 0, 0)
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>", nil)
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>", nil)
+
+	xobjects := ""
+	for i, img := range p.images {
+		smask := ""
+		if img.Alpha != nil {
+			n := obj(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /FlateDecode /Length %d >>",
+				img.Width, img.Height, len(img.Alpha)), img.Alpha)
+			smask = fmt.Sprintf(" /SMask %d 0 R", n)
+		}
+		n := obj(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%s /BitsPerComponent 8 /Filter /%s%s /Length %d >>",
+			img.Width, img.Height, img.ColorSpace, img.Filter, smask, len(img.Data)), img.Data)
+		xobjects += fmt.Sprintf(" /Im%d %d 0 R", i+1, n)
+	}
+	resources := "<< /Font << /F1 3 0 R /F2 4 0 R >> /XObject <<" + xobjects + " >> >>"
+
+	kids := []string{}
+	for _, page := range p.pages {
+		content := pdfDeflate(page.Bytes())
+		c := obj(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>", len(content)), content)
+		n := obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources %s /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, resources, c), nil)
+		kids = append(kids, fmt.Sprintf("%d 0 R", n))
+	}
+
+	offsets[0] = buf.Len()
+	buf.WriteString("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	offsets[1] = buf.Len()
+	fmt.Fprintf(&buf, "2 0 obj\n<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), len(kids))
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func pdfDeflate(data []byte) []byte {
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	zw.Write(data)
+	zw.Close()
+	return b.Bytes()
+}
+
+// loadPDFImage : Prepara una imagen JPEG o PNG (AVIF y otros formatos no se pueden decodificar sin dependencias)
+func loadPDFImage(data []byte) (*pdfImage, error) {
+	if bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		if err != nil { return nil, err }
+		cs := "DeviceRGB"
+		if cfg.ColorModel == color.GrayModel { cs = "DeviceGray" } else if cfg.ColorModel == color.CMYKModel { return nil, fmt.Errorf("JPEG CMYK no soportado") }
+		return &pdfImage{Width: cfg.Width, Height: cfg.Height, ColorSpace: cs, Filter: "DCTDecode", Data: data}, nil
+	}
+	if !bytes.HasPrefix(data, []byte("\x89PNG")) { return nil, fmt.Errorf("formato de imagen no soportado (use PNG o JPEG)") }
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil { return nil, err }
+
+	b := img.Bounds()
+	rgb := make([]byte, 0, b.Dx()*b.Dy()*3)
+	alpha := make([]byte, 0, b.Dx()*b.Dy())
+	opaque := true
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			rgb = append(rgb, c.R, c.G, c.B)
+			alpha = append(alpha, c.A)
+			if c.A != 255 { opaque = false }
+		}
+	}
+	out := &pdfImage{Width: b.Dx(), Height: b.Dy(), ColorSpace: "DeviceRGB", Filter: "FlateDecode", Data: pdfDeflate(rgb)}
+	if !opaque { out.Alpha = pdfDeflate(alpha) }
+	return out, nil
+}
+
+// --- TEXTO ---
+
+// pdfWinAnsi : Caracteres fuera de Latin-1 que sí existen en WinAnsiEncoding
+var pdfWinAnsi = map[rune]byte{'€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97}
+
+func pdfEncode(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		if b, ok := pdfWinAnsi[r]; ok {
+			out = append(out, b)
+		} else if r == '\t' || r == '\n' || r == '\r' {
+			out = append(out, ' ')
+		} else if r < 0x20 || r > 0xff || (r >= 0x7f && r < 0xa0) {
+			out = append(out, '?')
+		} else {
+			out = append(out, byte(r))
+		}
+	}
+	return out
+}
+
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, c := range pdfEncode(s) {
+		if c == '(' || c == ')' || c == '\\' { b.WriteByte('\\') }
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// Anchos (milésimas de em) de los caracteres 32..126 de Helvetica y Helvetica-Bold
+var pdfWidthsRegular = []int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+var pdfWidthsBold = []int{
+	278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+	975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+	333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+	611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+}
+
+// pdfAccentBase : Letras acentuadas que miden lo mismo que su letra base
+var pdfAccentBase = strings.NewReplacer(
+	"á", "a", "é", "e", "í", "i", "ó", "o", "ú", "u", "ü", "u", "ñ", "n",
+	"Á", "A", "É", "E", "Í", "I", "Ó", "O", "Ú", "U", "Ü", "U", "Ñ", "N")
+
+// pdfTextWidth : Ancho en puntos del texto
+func pdfTextWidth(s string, size float64, bold bool) float64 {
+	widths := pdfWidthsRegular
+	if bold { widths = pdfWidthsBold }
+	total := 0
+	for _, r := range pdfAccentBase.Replace(s) {
+		if r >= 32 && r <= 126 {
+			total += widths[r-32]
+		} else {
+			total += 556
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// pdfWrap : Divide el texto en líneas que caben en el ancho (respeta los saltos de línea)
+func pdfWrap(s string, size float64, bold bool, width float64) []string {
+	lines := []string{}
+	for _, para := range strings.Split(strings.ReplaceAll(s, "\r", ""), "\n") {
+		line := ""
+		for _, word := range strings.Fields(para) {
+			// Palabras más largas que la línea se cortan por caracteres
+			for pdfTextWidth(word, size, bold) > width {
+				cut := len([]rune(word)) - 1
+				for cut > 1 && pdfTextWidth(string([]rune(word)[:cut]), size, bold) > width { cut-- }
+				if line != "" { lines = append(lines, line); line = "" }
+				lines = append(lines, string([]rune(word)[:cut]))
+				word = string([]rune(word)[cut:])
+			}
+			if line == "" {
+				line = word
+			} else if pdfTextWidth(line+" "+word, size, bold) <= width {
+				line += " " + word
+			} else {
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
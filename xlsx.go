@@ -0,0 +1,210 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// --- HOJAS DE CÁLCULO XLSX (SOLO BIBLIOTECA ESTÁNDAR) ---
+
+const (
+	xlsxMaxColumns  = 16384    // Columnas A..XFD, el máximo de Excel
+	xlsxMaxPartSize = 50 << 20 // Tamaño descomprimido máximo de cada parte del ZIP
+)
+
+type xlsxRelationships struct {
+	Items []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxSharedStrings struct {
+	Items []struct {
+		T    string `xml:"t"`
+		Runs []struct {
+			T string `xml:"t"`
+		} `xml:"r"`
+	} `xml:"si"`
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		Cells []struct {
+			Ref    string `xml:"r,attr"`
+			Type   string `xml:"t,attr"`
+			Value  string `xml:"v"`
+			Inline struct {
+				T string `xml:"t"`
+			} `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// readXLSX : Filas de la primera hoja como texto. Las celdas vacías intermedias se devuelven como "".
+func readXLSX(data []byte) ([][]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil { return nil, fmt.Errorf("el archivo no es un XLSX válido") }
+	files := map[string]*zip.File{}
+	for _, f := range zr.File { files[f.Name] = f }
+
+	readXML := func(name string, v interface{}) error {
+		f, ok := files[name]
+		if !ok { return fmt.Errorf("falta %s en el XLSX", name) }
+		// El tamaño declarado puede ser falso: se limita también la lectura
+		tooBig := fmt.Errorf("%s excede %d MB descomprimido", name, xlsxMaxPartSize>>20)
+		if f.UncompressedSize64 > xlsxMaxPartSize { return tooBig }
+		rc, err := f.Open()
+		if err != nil { return err }
+		defer rc.Close()
+		raw, err := io.ReadAll(io.LimitReader(rc, xlsxMaxPartSize+1))
+		if err != nil { return fmt.Errorf("no se pudo leer %s: %v", name, err) }
+		if len(raw) > xlsxMaxPartSize { return tooBig }
+		return xml.Unmarshal(raw, v)
+	}
+
+	// Primera hoja según el libro; si no se puede resolver se usa sheet1.xml
+	sheetPath := "xl/worksheets/sheet1.xml"
+	var wb xlsxWorkbook
+	var rels xlsxRelationships
+	if readXML("xl/workbook.xml", &wb) == nil && len(wb.Sheets) > 0 && readXML("xl/_rels/workbook.xml.rels", &rels) == nil {
+		for _, rel := range rels.Items {
+			if rel.ID != wb.Sheets[0].RID { continue }
+			if strings.HasPrefix(rel.Target, "/") {
+				sheetPath = strings.TrimPrefix(rel.Target, "/")
+			} else {
+				sheetPath = path.Join("xl", rel.Target)
+			}
+		}
+	}
+
+	var shared xlsxSharedStrings
+	if _, ok := files["xl/sharedStrings.xml"]; ok {
+		if err := readXML("xl/sharedStrings.xml", &shared); err != nil { return nil, err }
+	}
+	strs := make([]string, len(shared.Items))
+	for i, si := range shared.Items {
+		s := si.T
+		for _, r := range si.Runs { s += r.T }
+		strs[i] = s
+	}
+
+	var sheet xlsxSheet
+	if err := readXML(sheetPath, &sheet); err != nil { return nil, err }
+
+	rows := [][]string{}
+	for _, row := range sheet.Rows {
+		cells := []string{}
+		for i, c := range row.Cells {
+			col := i
+			if c.Ref != "" {
+				if col, err = xlsxColumnIndex(c.Ref); err != nil { return nil, err }
+			}
+			if col >= xlsxMaxColumns { return nil, fmt.Errorf("la fila %d tiene más de %d columnas", len(rows)+1, xlsxMaxColumns) }
+			for len(cells) < col { cells = append(cells, "") }
+			val := c.Value
+			switch c.Type {
+			case "s":
+				if n, err := strconv.Atoi(c.Value); err == nil && n >= 0 && n < len(strs) { val = strs[n] }
+			case "inlineStr":
+				val = c.Inline.T
+			case "n", "":
+				// Códigos numéricos largos llegan como 1.2345E+5
+				if f, err := strconv.ParseFloat(val, 64); err == nil && strings.ContainsAny(val, "eE") {
+					val = strconv.FormatFloat(f, 'f', -1, 64)
+				}
+			}
+			if col < len(cells) { cells[col] = val } else { cells = append(cells, val) }
+		}
+		rows = append(rows, cells)
+	}
+	return rows, nil
+}
+
+// xlsxColumnIndex : "C7" -> 2. Solo acepta columnas A..XFD.
+func xlsxColumnIndex(ref string) (int, error) {
+	n := 0
+	for _, c := range ref {
+		if c < 'A' || c > 'Z' { break }
+		n = n*26 + int(c-'A'+1)
+		if n > xlsxMaxColumns { break }
+	}
+	if n < 1 || n > xlsxMaxColumns { return 0, fmt.Errorf("referencia de celda inválida: %q", ref) }
+	return n - 1, nil
+}
+
+// xlsxColumnName : 2 -> "C"
+func xlsxColumnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// writeXLSX : Libro de una hoja con encabezado en negrita. Todas las celdas se escriben como texto.
+func writeXLSX(w io.Writer, sheetName string, header []string, rows [][]string) error {
+	zw := zip.NewWriter(w)
+	add := func(name, content string) error {
+		f, err := zw.Create(name)
+		if err != nil { return err }
+		_, err = io.WriteString(f, content)
+		return err
+	}
+
+	files := []struct{ name, content string }{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/><Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/></Types>`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="` + xmlEscape(sheetName) + `" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/></Relationships>`},
+		{"xl/styles.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts><fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills><borders count="1"><border/></borders><cellStyleXfs count="1"><xf/></cellStyleXfs><cellXfs count="2"><xf fontId="0"/><xf fontId="1" applyFont="1"/></cellXfs></styleSheet>`},
+	}
+	for _, f := range files {
+		if err := add(f.name, f.content); err != nil { return err }
+	}
+
+	sheet, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil { return err }
+	io.WriteString(sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	writeRow := func(n int, cells []string, style string) {
+		var b strings.Builder
+		fmt.Fprintf(&b, `<row r="%d">`, n)
+		for i, v := range cells {
+			fmt.Fprintf(&b, `<c r="%s%d" t="inlineStr"%s><is><t xml:space="preserve">%s</t></is></c>`, xlsxColumnName(i), n, style, xmlEscape(v))
+		}
+		b.WriteString(`</row>`)
+		io.WriteString(sheet, b.String())
+	}
+	writeRow(1, header, ` s="1"`)
+	for i, row := range rows {
+		writeRow(i+2, row, "")
+	}
+	io.WriteString(sheet, `</sheetData></worksheet>`)
+	return zw.Close()
+}
+
+// xmlEscape : Texto con los caracteres especiales de XML escapados, para contenido y atributos
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// buildZip : XLSX hecho a mano con las partes indicadas, para probar archivos que writeXLSX no genera
+func buildZip(t *testing.T, parts map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range parts {
+		f, err := zw.Create(name)
+		if err != nil { t.Fatal(err) }
+		if _, err := f.Write([]byte(content)); err != nil { t.Fatal(err) }
+	}
+	if err := zw.Close(); err != nil { t.Fatal(err) }
+	return buf.Bytes()
+}
+
+func sheetXML(rows string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?><worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>` + rows + `</sheetData></worksheet>`
+}
+
+func TestXLSXRoundTrip(t *testing.T) {
+	header := []string{"Tipo", "Código", "Observación"}
+	rows := [][]string{
+		{"Computadora", "BN-0001", "Pantalla <rota> & teclado"},
+		{"Impresora", "", "  espacios al inicio"},
+		{"Router", "00012345", ""},
+	}
+	var buf bytes.Buffer
+	if err := writeXLSX(&buf, "Equipos", header, rows); err != nil { t.Fatal(err) }
+	got, err := readXLSX(buf.Bytes())
+	if err != nil { t.Fatal(err) }
+	want := append([][]string{header}, rows...)
+	if !reflect.DeepEqual(got, want) { t.Fatalf("ida y vuelta:\n got %q\nwant %q", got, want) }
+}
+
+func TestReadXLSXSparseAndSharedStrings(t *testing.T) {
+	data := buildZip(t, map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Datos" sheetId="1" r:id="rId7"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId7" Target="/xl/worksheets/datos.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><si><t>Tipo</t></si><si><t>Serial</t></si><si><r><t>Lap</t></r><r><t>top</t></r></si></sst>`,
+		"xl/worksheets/datos.xml": sheetXML(
+			`<row r="1"><c r="A1" t="s"><v>0</v></c><c r="C1" t="s"><v>1</v></c></row>` +
+				`<row r="2"><c r="C2"><v>1.2345E+5</v></c><c r="A2" t="s"><v>2</v></c></row>` +
+				`<row r="3"><c r="B3" t="inlineStr"><is><t>solo B</t></is></c></row>`),
+	})
+	got, err := readXLSX(data)
+	if err != nil { t.Fatal(err) }
+	want := [][]string{
+		{"Tipo", "", "Serial"},
+		{"Laptop", "", "123450"},
+		{"", "solo B"},
+	}
+	if !reflect.DeepEqual(got, want) { t.Fatalf("got %q, want %q", got, want) }
+}
+
+func TestReadXLSXRejectsBadFiles(t *testing.T) {
+	cases := []struct {
+		name  string
+		parts map[string]string
+		err   string
+	}{
+		{"referencia sin letras", map[string]string{"xl/worksheets/sheet1.xml": sheetXML(`<row><c r="17"><v>1</v></c></row>`)}, "referencia de celda inválida"},
+		{"columna fuera de rango", map[string]string{"xl/worksheets/sheet1.xml": sheetXML(`<row><c r="ZZZZZZZZ1"><v>1</v></c></row>`)}, "referencia de celda inválida"},
+		{"columna XFE", map[string]string{"xl/worksheets/sheet1.xml": sheetXML(`<row><c r="XFE1"><v>1</v></c></row>`)}, "referencia de celda inválida"},
+		{"parte demasiado grande", map[string]string{"xl/worksheets/sheet1.xml": sheetXML(strings.Repeat(" ", xlsxMaxPartSize))}, "excede"},
+		{"sin hoja", map[string]string{"xl/styles.xml": `<styleSheet/>`}, "falta xl/worksheets/sheet1.xml"},
+	}
+	for _, c := range cases {
+		_, err := readXLSX(buildZip(t, c.parts))
+		if err == nil || !strings.Contains(err.Error(), c.err) { t.Errorf("%s: error = %v, se esperaba %q", c.name, err, c.err) }
+	}
+	if _, err := readXLSX([]byte("PK no es zip")); err == nil { t.Error("se aceptó un ZIP corrupto") }
+}
+
+func TestXLSXColumnIndex(t *testing.T) {
+	for ref, want := range map[string]int{"A1": 0, "C7": 2, "Z3": 25, "AA10": 26, "XFD1048576": xlsxMaxColumns - 1} {
+		got, err := xlsxColumnIndex(ref)
+		if err != nil || got != want { t.Errorf("xlsxColumnIndex(%q) = %d, %v; se esperaba %d", ref, got, err, want) }
+		if name := xlsxColumnName(want); !strings.HasPrefix(ref, name) { t.Errorf("xlsxColumnName(%d) = %q", want, name) }
+	}
+}
+
+func TestImportHeaderKey(t *testing.T) {
+	cases := map[string]string{
+		"Código Bien Nacional": "codigobiennacional",
+		"\ufeffTipo":           "tipo",
+		"  Año de Compra ":     "anodecompra",
+		"RAM (GB)":             "ramgb",
+		"ÑANDÚ":                "nandu",
+		"":                     "",
+	}
+	for in, want := range cases {
+		if got := importHeaderKey(in); got != want { t.Errorf("importHeaderKey(%q) = %q, se esperaba %q", in, got, want) }
+	}
+}
+
+func TestReadImportFile(t *testing.T) {
+	var xlsx bytes.Buffer
+	if err := writeXLSX(&xlsx, "Equipos", []string{"Tipo", "Código"}, [][]string{{"Router", "BN-7"}}); err != nil { t.Fatal(err) }
+
+	cases := []struct {
+		name     string
+		data     string
+		filename string
+		want     [][]string
+	}{
+		{"coma", "Tipo,Código\nRouter,BN-7\n", "equipos.csv", [][]string{{"Tipo", "Código"}, {"Router", "BN-7"}}},
+		{"punto y coma con BOM", "\xef\xbb\xbfTipo;Código\r\nRouter;\"BN,7\"\r\n", "equipos.csv", [][]string{{"Tipo", "Código"}, {"Router", "BN,7"}}},
+		{"coma en el texto no cambia el separador", "Tipo;Marca;Código\nRouter;Tp-Link, Inc;BN-7\n", "", [][]string{{"Tipo", "Marca", "Código"}, {"Router", "Tp-Link, Inc", "BN-7"}}},
+		{"filas de distinto largo", "Tipo,Código,Serial\nRouter\n", "", [][]string{{"Tipo", "Código", "Serial"}, {"Router"}}},
+		{"XLSX por contenido", xlsx.String(), "", [][]string{{"Tipo", "Código"}, {"Router", "BN-7"}}},
+		{"XLSX por nombre", xlsx.String(), "Equipos.XLSX", [][]string{{"Tipo", "Código"}, {"Router", "BN-7"}}},
+	}
+	for _, c := range cases {
+		got, err := readImportFile([]byte(c.data), c.filename)
+		if err != nil { t.Errorf("%s: %v", c.name, err); continue }
+		if !reflect.DeepEqual(got, c.want) { t.Errorf("%s: got %q, want %q", c.name, got, c.want) }
+	}
+	if _, err := readImportFile([]byte("Tipo,Código\n"), "equipos.xlsx"); err == nil { t.Error("un CSV llamado .xlsx debería fallar") }
+}